@@ -16,88 +16,86 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	server "github.com/microcks/microcks-testcontainers-go-demo/cmd/run"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/config"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
 )
 
-const (
-	defaultPastryAPIURL   = "http://localhost:9090/rest/API+Pastries/0.0.1"
-	defaultKafkaBootstrap = "localhost:9092"
-	shutdownTimeout       = 15 * time.Second
-	defaultOrdersTopic    = "orders-created"
-	defaultReviewedTopic  = "OrderEventsAPI-0.1.0-orders-reviewed"
-)
-
-// Config holds all application configuration.
-type Config struct {
-	PastryAPIURL   string
-	KafkaBootstrap string
-	OrdersTopic    string
-	ReviewedTopic  string
-}
+const shutdownTimeout = 15 * time.Second
 
-// loadConfig loads configuration from environment variables with defaults.
-func loadConfig() *Config {
-	return &Config{
-		PastryAPIURL:   getEnv("PASTRY_API_URL", defaultPastryAPIURL),
-		KafkaBootstrap: getEnv("KAFKA_BOOTSTRAP_URL", defaultKafkaBootstrap),
-		OrdersTopic:    getEnv("ORDERS_TOPIC", defaultOrdersTopic),
-		ReviewedTopic:  getEnv("REVIEWED_TOPIC", defaultReviewedTopic),
+// newLogger creates the logger of the application, in the configured format and filtering
+// records below the configured level.
+func newLogger(cfg *config.Config) (*slog.Logger, error) {
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// getEnv retrieves an environment variable with a default value.
-func getEnv(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	}
-	return defaultValue
+	return logging.New(os.Stderr, cfg.LogFormat, level)
 }
 
 func main() {
 	if err := run(); err != nil {
-		log.Fatalf("Application error: %v", err)
+		slog.Error("Application error", "error", err)
+		os.Exit(1)
 	}
 }
 
 func run() error {
-	// Setup logging
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	// Load configuration, from file, environment and flags.
+	cfg, err := config.Load(os.Args[1:], os.Environ())
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
 
-	// Load configuration
-	config := loadConfig()
+	// Setup logging
+	logger, err := newLogger(cfg)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
 
 	// Create application properties
 	appProps := &internal.ApplicationProperties{
-		PastriesBaseURL:          config.PastryAPIURL,
-		OrderEventsCreatedTopic:  config.OrdersTopic,
-		OrderEventsReviewedTopic: config.ReviewedTopic,
-		KafkaConfigMap: &kafka.ConfigMap{
-			"bootstrap.servers": config.KafkaBootstrap,
-			"group.id":          "order-service",
-			"auto.offset.reset": "latest",
-		},
+		PastriesBaseURL:          cfg.PastryAPIURL,
+		OrderEventsCreatedTopic:  cfg.OrdersTopic,
+		OrderEventsReviewedTopic: cfg.ReviewedTopic,
+		OrderEventsFailedTopic:   cfg.FailedTopic,
+		HTTPAddr:                 cfg.HTTPAddr,
+		KafkaConfigMap:           cfg.KafkaConfigMap(),
+		ReplayOrderEvents:        cfg.ReplayOrders,
+		OrderReviewSLA:           cfg.ReviewSLA,
+		OTLPEndpoint:             cfg.OTLPEndpoint,
+		Logger:                   logger,
 	}
 
 	// Create application
-	app := server.NewApplication(appProps)
+	app, err := server.NewApplication(appProps)
+	if err != nil {
+		return fmt.Errorf("failed to create application: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Setup error channel
 	errChan := make(chan error, 1)
 
 	// Start application in a goroutine
 	go func() {
-		log.Printf("Starting application with Pastry API URL: %s, Kafka bootstrap: %s",
-			config.PastryAPIURL, config.KafkaBootstrap)
-		if err := app.Start(); err != nil {
+		logger.Info("Starting application", "pastryAPIURL", cfg.PastryAPIURL, "kafkaBootstrap", cfg.Kafka["bootstrap.servers"])
+		if err := app.Start(ctx); err != nil {
 			errChan <- fmt.Errorf("failed to start application: %w", err)
 		}
 	}()
@@ -110,35 +108,24 @@ func run() error {
 	var shutdownErr error
 	select {
 	case sig := <-sigChan:
-		log.Printf("Received signal: %v", sig)
+		logger.Info("Received signal", "signal", sig.String())
 	case err := <-errChan:
-		log.Printf("Received error: %v", err)
+		logger.Error("Received error", "error", err)
 		shutdownErr = err
 	}
 
 	// Graceful shutdown
-	log.Println("Starting graceful shutdown...")
+	logger.Info("Starting graceful shutdown...")
 
 	// Create shutdown context with timeout
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer shutdownCancel()
 
-	// Stop the application
-	shutdownChan := make(chan struct{})
-	go func() {
-		if err := app.Stop(); err != nil {
-			log.Printf("Error during shutdown: %v", err)
-		}
-		close(shutdownChan)
-	}()
-
-	// Wait for shutdown or timeout
-	select {
-	case <-shutdownCtx.Done():
-		return fmt.Errorf("shutdown timed out: %v", shutdownCtx.Err())
-	case <-shutdownChan:
-		log.Println("Graceful shutdown completed")
+	// Stop the application within the shutdown timeout.
+	if err := app.Stop(shutdownCtx); err != nil {
+		return fmt.Errorf("graceful shutdown failed: %w", err)
 	}
+	logger.Info("Graceful shutdown completed")
 
 	return shutdownErr
 }
@@ -0,0 +1,80 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"net/http"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+)
+
+// Option allows replacing components of an App built with NewApplication, to embed or
+// test it. Kafka clients are only created for the components that are not replaced.
+type Option func(*options)
+
+type options struct {
+	pastryAPI       client.PastryAPI
+	orderPublisher  service.OrderEventPublisher
+	newListener     func(orderService service.OrderService) service.OrderEventListener
+	newReplayer     func(orderService service.OrderService) service.OrderEventReplayer
+	orderRepository service.OrderRepository
+	middlewares     []func(http.Handler) http.Handler
+}
+
+// WithPastryAPI replaces the Pastry API client, used as is: without cache nor retries.
+func WithPastryAPI(pastryAPI client.PastryAPI) Option {
+	return func(o *options) {
+		o.pastryAPI = pastryAPI
+	}
+}
+
+// WithOrderEventPublisher replaces the Kafka publisher of order events.
+func WithOrderEventPublisher(publisher service.OrderEventPublisher) Option {
+	return func(o *options) {
+		o.orderPublisher = publisher
+	}
+}
+
+// WithOrderEventListener replaces the Kafka listener of order reviews by the one newListener
+// creates for the order service of the application.
+func WithOrderEventListener(newListener func(orderService service.OrderService) service.OrderEventListener) Option {
+	return func(o *options) {
+		o.newListener = newListener
+	}
+}
+
+// WithOrderEventReplayer replaces the Kafka replayer of order events by the one newReplayer
+// creates for the order service of the application. Orders are then rebuilt on start.
+func WithOrderEventReplayer(newReplayer func(orderService service.OrderService) service.OrderEventReplayer) Option {
+	return func(o *options) {
+		o.newReplayer = newReplayer
+	}
+}
+
+// WithOrderRepository replaces the in-memory storage of orders.
+func WithOrderRepository(repository service.OrderRepository) Option {
+	return func(o *options) {
+		o.orderRepository = repository
+	}
+}
+
+// WithMiddleware wraps the HTTP handler of the application with middleware. Middlewares are
+// applied in order, the first one being the outermost.
+func WithMiddleware(middleware func(http.Handler) http.Handler) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, middleware)
+	}
+}
@@ -16,29 +16,41 @@ package run
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
-	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/google/uuid"
 	app "github.com/microcks/microcks-testcontainers-go-demo/internal"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/controller"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-const (
-	// DefaultApplicationPort represents the default port used for exposiing the application.
-	DefaultApplicationPort = 9000
-)
+// DefaultApplicationPort represents the default port used for exposiing the application.
+const DefaultApplicationPort = app.DefaultApplicationPort
 
 // Application is the application interface for starting/stopping it.
 type Application interface {
 	// Start this demo application using properties.
-	Start() error
-	// Stop this demo application.
-	Stop() error
+	Start(ctx context.Context) error
+	// Stop this demo application within the deadline of ctx.
+	Stop(ctx context.Context) error
 }
 
 type App struct {
@@ -47,100 +59,444 @@ type App struct {
 	kafkaProducer   *kafka.Producer
 	pastryAPIClient client.PastryAPI
 	orderListener   service.OrderEventListener
+	orderReplayer   service.OrderEventReplayer
+	orderExpirer    service.OrderExpirer
+	replayConsumer  *kafka.Consumer
+	tracerProvider  *sdktrace.TracerProvider
 	server          *http.Server
+	listener        net.Listener
+	ready           atomic.Bool
+	replaying       atomic.Bool
+	logger          *slog.Logger
 
 	AppService app.ApplicationServices
 }
 
-func NewApplication(applicationProperties *app.ApplicationProperties) *App {
-	// Initialize kafka server.
-	kafkaServer, err := applicationProperties.KafkaConfigMap.Get("bootstrap.servers", "unknown")
-	if err != nil {
-		fmt.Println("No bootstrap.servers specified for KafkaServer", err)
-		os.Exit(1)
+// NewApplication prepares the application from its properties, with components replaced by
+// opts. Kafka clients created before an error are closed.
+func NewApplication(applicationProperties *app.ApplicationProperties, opts ...Option) (_ *App, err error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
 	}
 
+	logger := applicationProperties.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	a := &App{logger: logger}
+	defer func() {
+		if err != nil {
+			_ = a.closeClients()
+		}
+	}()
+
 	// Initialize your application
-	fmt.Println("Starting Microcks TestContainers Go Demo application...")
-	fmt.Printf("  Connecting to Kafka server: %s \n", kafkaServer)
-	fmt.Printf("  Connecting to Microcks Pastries: %s \n", applicationProperties.PastriesBaseURL)
+	logger.Info("Starting Microcks TestContainers Go Demo application...",
+		"pastriesBaseURL", applicationProperties.PastriesBaseURL)
 
 	// Prepare Kafka components we need.
+	needsKafka := o.orderPublisher == nil || o.newListener == nil || (applicationProperties.ReplayOrderEvents && o.newReplayer == nil)
+	if needsKafka {
+		if applicationProperties.KafkaConfigMap == nil {
+			return nil, errors.New("no Kafka configuration specified")
+		}
+		kafkaServer, err := applicationProperties.KafkaConfigMap.Get("bootstrap.servers", "")
+		if err != nil || kafkaServer == "" {
+			return nil, fmt.Errorf("no bootstrap.servers specified for Kafka: %v", err)
+		}
+		logger.Info("Connecting to Kafka server", "kafkaServer", kafkaServer)
 
-	kafkaConsumer, err := kafka.NewConsumer(applicationProperties.KafkaConfigMap)
-	if err != nil {
-		fmt.Println("Error while connecting to Kafka broker", err)
-		os.Exit(1)
+		if o.newListener == nil {
+			if a.kafkaConsumer, err = kafka.NewConsumer(applicationProperties.KafkaConfigMap); err != nil {
+				return nil, fmt.Errorf("failed to create Kafka consumer: %w", err)
+			}
+		}
+		if o.orderPublisher == nil {
+			if a.kafkaProducer, err = kafka.NewProducer(producerConfigMap(applicationProperties.KafkaConfigMap)); err != nil {
+				return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+			}
+		}
 	}
-	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers": kafkaServer,
-	})
-	if err != nil {
-		fmt.Println("Error while connecting to Kafka broker", err)
-		os.Exit(1)
+
+	// Export traces if a collector is configured.
+	if applicationProperties.OTLPEndpoint != "" {
+		logger.Info("Exporting traces", "endpoint", applicationProperties.OTLPEndpoint)
+		if a.tracerProvider, err = tracing.NewTracerProvider(context.Background(), applicationProperties.OTLPEndpoint); err != nil {
+			return nil, fmt.Errorf("failed to set up traces export: %w", err)
+		}
+		tracing.SetTracerProvider(a.tracerProvider)
 	}
 
-	// Prepare our own components and services.
-	pastryAPIClient := client.NewPastryAPIClient(strings.ReplaceAll(applicationProperties.PastriesBaseURL, " ", "+"))
-	orderPublisher := service.NewOrderEventPublisher(kafkaProducer, applicationProperties.OrderEventsCreatedTopic)
-	orderService := service.NewOrderService(pastryAPIClient, orderPublisher)
-	orderController := controller.NewOrderController(orderService)
+	// Prepare metrics of the application and of the Go runtime.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	appMetrics := metrics.New(registry)
 
-	// Initialize and start the event listener.
-	orderListener := service.NewOrderEventListener(kafkaConsumer, applicationProperties.OrderEventsReviewedTopic, orderService)
+	// Prepare our own components and services. Pastry API is checked without cache to tell
+	// if it can actually be reached, and stock is read without cache as others change it.
+	pastryAPIClient, pastryAPIUncached := o.pastryAPI, o.pastryAPI
+	if pastryAPIClient == nil {
+		pastryAPIRemote := client.NewPastryAPIClient(strings.ReplaceAll(applicationProperties.PastriesBaseURL, " ", "+"),
+			client.WithTimeout(5*time.Second),
+			client.WithRetries(2, 200*time.Millisecond),
+			client.WithCircuitBreaker(5, 30*time.Second),
+			client.WithMetrics(appMetrics),
+		)
+		pastryAPIClient = client.NewCachedPastryAPI(pastryAPIRemote, client.WithStaleIfError(5*time.Minute))
+		pastryAPIUncached = pastryAPIRemote
+	}
+	a.pastryAPIClient = pastryAPIClient
 
-	// Define your HTTP routes
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handler)
-	mux.HandleFunc("/api/orders", orderController.CreateOrder)
-
-	// Start your HTTP server
-	fmt.Println("Microcks TestContainers Go Demo application is listening on localhost:9000")
-	fmt.Println("")
-
-	// go http.ListenAndServe(":9000", nil)
-	server := &http.Server{Addr: ":9000", Handler: mux}
-
-	return &App{
-		appServices:     app.ApplicationServices{},
-		kafkaConsumer:   kafkaConsumer,
-		kafkaProducer:   kafkaProducer,
-		pastryAPIClient: pastryAPIClient,
-		orderListener:   orderListener,
-		AppService: app.ApplicationServices{
-			OrderService: orderService,
+	orderPublisher := o.orderPublisher
+	if orderPublisher == nil {
+		publisherOpts := []service.OrderEventPublisherOption{service.WithPublisherMetrics(appMetrics), service.WithPublisherLogger(logger)}
+		if applicationProperties.OrderEventsFailedTopic != "" {
+			publisherOpts = append(publisherOpts,
+				service.WithReasonTopic(service.ReviewTimeoutReason, applicationProperties.OrderEventsFailedTopic))
+		}
+		orderPublisher = service.NewOrderEventPublisher(a.kafkaProducer, applicationProperties.OrderEventsCreatedTopic, publisherOpts...)
+	}
+	serviceOpts := []service.OrderServiceOption{service.WithMetrics(appMetrics), service.WithLogger(logger),
+		service.WithStockPastryAPI(pastryAPIUncached)}
+	if o.orderRepository != nil {
+		serviceOpts = append(serviceOpts, service.WithOrderRepository(o.orderRepository))
+	}
+	orderService := service.NewOrderService(pastryAPIClient, orderPublisher, serviceOpts...)
+	orderController := controller.NewOrderController(orderService, controller.WithLogger(logger))
+	a.AppService = app.ApplicationServices{OrderService: orderService}
+
+	// Initialize the event listener.
+	if o.newListener != nil {
+		a.orderListener = o.newListener(orderService)
+	} else {
+		a.orderListener = service.NewOrderEventListener(a.kafkaConsumer, applicationProperties.OrderEventsReviewedTopic, orderService,
+			service.WithListenerMetrics(appMetrics), service.WithListenerLogger(logger))
+	}
+
+	// Prepare the replay of order events if orders have to be rebuilt.
+	if o.newReplayer != nil {
+		a.orderReplayer = o.newReplayer(orderService)
+	} else if applicationProperties.ReplayOrderEvents {
+		if a.replayConsumer, err = kafka.NewConsumer(replayConfigMap(applicationProperties.KafkaConfigMap)); err != nil {
+			return nil, fmt.Errorf("failed to create Kafka replay consumer: %w", err)
+		}
+		topics := []string{applicationProperties.OrderEventsCreatedTopic, applicationProperties.OrderEventsReviewedTopic}
+		if applicationProperties.OrderEventsFailedTopic != "" {
+			topics = append(topics, applicationProperties.OrderEventsFailedTopic)
+		}
+		a.orderReplayer = service.NewOrderEventReplayer(a.replayConsumer, topics, orderService, service.WithReplayerLogger(logger))
+	}
+
+	// Fail orders that are not reviewed in time.
+	if applicationProperties.OrderReviewSLA > 0 {
+		a.orderExpirer = service.NewOrderExpirer(orderService, service.WithReviewSLA(applicationProperties.OrderReviewSLA),
+			service.WithExpirerLogger(logger))
+	}
+
+	// Check components the application cannot work without. The Pastry API is checked at most
+	// every 10 seconds so that probes neither load it nor open the circuit for orders.
+	orderListener := a.orderListener
+	checks := map[string]controller.HealthCheck{
+		"pastryAPI": controller.CachedHealthCheck(func(ctx context.Context) error {
+			_, err := pastryAPIUncached.ListPastries(ctx, "S")
+			return err
+		}, 10*time.Second),
+		"orderListener": func(_ context.Context) error {
+			if !orderListener.Running() {
+				return errors.New("order reviews are not consumed")
+			}
+			return nil
 		},
-		server: server,
 	}
+	if a.orderReplayer != nil {
+		a.replaying.Store(true)
+		checks["orderReplay"] = func(_ context.Context) error {
+			if a.replaying.Load() {
+				return errors.New("orders are being rebuilt")
+			}
+			return nil
+		}
+	}
+	if a.kafkaProducer != nil {
+		checks["kafkaProducer"] = kafkaCheck(a.kafkaProducer)
+	}
+	if a.kafkaConsumer != nil {
+		checks["kafkaConsumer"] = kafkaCheck(a.kafkaConsumer)
+	}
+	healthController := controller.NewHealthController(checks)
+
+	// Define your HTTP routes. Health probes are not logged as they are frequent. Orders
+	// cannot be used until they are rebuilt.
+	mux := http.NewServeMux()
+	route := func(pattern, route string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, controller.InstrumentHandler(appMetrics, route, handler))
+	}
+	logged := func(handler http.HandlerFunc) http.HandlerFunc {
+		return controller.LogRequests(logger, controller.RequireReady(func() bool { return !a.replaying.Load() }, handler))
+	}
+	route("/", "/", logged(handler))
+	route("GET /healthz", "/healthz", healthController.Liveness)
+	route("GET /readyz", "/readyz", healthController.Readiness)
+	route("/api/orders", "/api/orders", logged(orderController.CreateOrder))
+	route("PUT /api/orders/{id}", "/api/orders/{id}", logged(orderController.AmendOrder))
+	route("GET /api/orders/{id}/history", "/api/orders/{id}/history", logged(orderController.GetOrderHistory))
+	mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	var rootHandler http.Handler = mux
+	for i := len(o.middlewares) - 1; i >= 0; i-- {
+		rootHandler = o.middlewares[i](rootHandler)
+	}
+
+	// Bind now so that the address is known, and already in use errors reported, before starting.
+	httpAddr := applicationProperties.HTTPAddr
+	if httpAddr == "" {
+		httpAddr = app.DefaultHTTPAddr()
+	}
+	if a.listener, err = net.Listen("tcp", httpAddr); err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", httpAddr, err)
+	}
+	a.server = &http.Server{Addr: a.listener.Addr().String(), Handler: rootHandler}
+	return a, nil
 }
 
-func (a *App) Start() error {
-	_, err := a.orderListener.Listen(context.Background())
-	if err != nil {
-		fmt.Println("Error while starting consuming orders reviews", err)
-		os.Exit(1)
+// Addr returns the address the application listens on, with the actual port if port 0 was
+// requested.
+func (a *App) Addr() net.Addr {
+	return a.listener.Addr()
+}
+
+// BaseURL returns the URL of the application, on localhost if it listens on all interfaces.
+func (a *App) BaseURL() string {
+	host := "localhost"
+	addr, ok := a.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return "http://" + a.listener.Addr().String()
 	}
+	if !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
 
-	return a.server.ListenAndServe()
+// Handler returns the HTTP handler of the application, to be served by another server.
+func (a *App) Handler() http.Handler {
+	return a.server.Handler
 }
 
-func (a *App) Stop() error {
-	fmt.Println("Stopping Microcks TestContainers Go Demo application...")
-	a.orderListener.Stop()
+// Start serves requests, rebuilding orders first if required, then starts consuming orders
+// reviews. Health probes are answered during the replay, while /readyz and the API answer 503
+// until it completes. It returns when the application cannot start, or nil once stopped by
+// Stop. Cancelling ctx stops the replay, the listener and the expiry of orders.
+func (a *App) Start(ctx context.Context) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- a.server.Serve(a.listener)
+	}()
+	a.logger.Info("Microcks TestContainers Go Demo application is listening", "addr", a.server.Addr, "url", a.BaseURL())
 
-	fmt.Println("Stopping Kafka producer & consumer...")
-	if a.kafkaConsumer != nil && !a.kafkaConsumer.IsClosed() {
-		if err := a.kafkaConsumer.Close(); err != nil {
+	if err := a.startProcessing(ctx); err != nil {
+		_ = a.server.Close()
+		<-served
+		return err
+	}
+	a.ready.Store(true)
+
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// startProcessing rebuilds orders if required, then starts consuming orders reviews and
+// expiring orders not reviewed in time.
+func (a *App) startProcessing(ctx context.Context) error {
+	if a.orderReplayer != nil {
+		if err := a.replayOrderEvents(ctx); err != nil {
 			return err
 		}
+		a.replaying.Store(false)
+	}
+
+	if _, err := a.orderListener.Listen(ctx); err != nil {
+		return fmt.Errorf("failed to start consuming orders reviews: %w", err)
+	}
+	if a.orderExpirer != nil {
+		a.orderExpirer.Start(ctx)
+	}
+	return nil
+}
+
+// Ready tells if orders have been rebuilt and the application serves requests.
+func (a *App) Ready() bool {
+	return a.ready.Load()
+}
+
+// replayOrderEvents rebuilds orders from order events topics before orders can be used.
+func (a *App) replayOrderEvents(ctx context.Context) error {
+	a.logger.Info("Rebuilding orders from order events...")
+	start := time.Now()
+	replayed, err := a.orderReplayer.Replay(ctx)
+	if a.replayConsumer != nil {
+		if closeErr := a.replayConsumer.Close(); closeErr != nil {
+			a.logger.Warn("Error while closing replay consumer", "error", closeErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rebuild orders: %w", err)
+	}
+	a.logger.Info("Rebuilt orders from order events", "events", replayed, "duration", time.Since(start).Round(time.Millisecond).String())
+	return nil
+}
+
+// consumerProperties are the properties of the application configuration that only apply to
+// consumers. Go client ones are rejected by producers.
+var consumerProperties = []string{
+	"group.id", "group.instance.id", "auto.offset.reset", "enable.auto.commit", "auto.commit.interval.ms",
+	"enable.auto.offset.store", "session.timeout.ms", "heartbeat.interval.ms", "max.poll.interval.ms",
+	"partition.assignment.strategy", "isolation.level", "go.application.rebalance.enable", "go.events.channel.enable",
+}
+
+// defaultMessageTimeout bounds how long an order event is retried, and its request waits,
+// before its publication fails.
+const defaultMessageTimeout = 10 * time.Second
+
+// producerConfigMap derives the configuration of the producer from the application one, so
+// that it connects to brokers with the same security settings as consumers.
+func producerConfigMap(configMap *kafka.ConfigMap) *kafka.ConfigMap {
+	producerConfig := kafka.ConfigMap{}
+	for key, value := range *configMap {
+		if !slices.Contains(consumerProperties, key) {
+			producerConfig[key] = value
+		}
+	}
+	_, hasMessageTimeout := producerConfig["message.timeout.ms"]
+	_, hasDeliveryTimeout := producerConfig["delivery.timeout.ms"]
+	if !hasMessageTimeout && !hasDeliveryTimeout {
+		producerConfig["message.timeout.ms"] = int(defaultMessageTimeout.Milliseconds())
+	}
+	return &producerConfig
+}
+
+// replayConfigMap derives the configuration of the replay consumer from the application one.
+// Its group is unique so that replaying never moves offsets of the application group.
+func replayConfigMap(configMap *kafka.ConfigMap) *kafka.ConfigMap {
+	replayConfig := kafka.ConfigMap{}
+	maps.Copy(replayConfig, *configMap)
+	replayConfig["group.id"] = "order-service-replay-" + uuid.NewString()
+	replayConfig["auto.offset.reset"] = "earliest"
+	replayConfig["enable.auto.commit"] = false
+	return &replayConfig
+}
+
+// Stop gracefully stops the application within the deadline of ctx. It first stops accepting
+// requests and waits for the ones in flight, so that the events they produce are not lost. It
+// then stops consuming orders reviews once processed ones are committed, stops the expiry of
+// orders and flushes pending events before closing Kafka clients.
+func (a *App) Stop(ctx context.Context) error {
+	a.logger.Info("Stopping Microcks TestContainers Go Demo application...")
+	a.ready.Store(false)
+	err := a.server.Shutdown(ctx)
+	if err != nil {
+		err = fmt.Errorf("failed to drain in-flight requests: %w", err)
+	}
+	a.closeListener()
+
+	// The consumer cannot be closed while the listener may still use it.
+	listenerStopped := true
+	if waitErr := waitFor(ctx, a.orderListener.Stop); waitErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to stop consuming orders reviews: %w", waitErr))
+		listenerStopped = false
+	}
+	if a.orderExpirer != nil {
+		a.orderExpirer.Stop()
 	}
 
+	a.logger.Info("Stopping Kafka producer & consumer...")
+	if a.kafkaProducer != nil {
+		if pending := a.flushProducer(ctx); pending > 0 {
+			err = errors.Join(err, fmt.Errorf("%d order events not delivered: %w", pending, ctx.Err()))
+		}
+	}
+	if listenerStopped {
+		err = errors.Join(err, a.closeClients())
+	}
+
+	// Send remaining traces.
+	if a.tracerProvider != nil {
+		if shutdownErr := a.tracerProvider.Shutdown(ctx); shutdownErr != nil {
+			a.logger.Warn("Error while exporting remaining traces", "error", shutdownErr)
+		}
+	}
+	return err
+}
+
+// flushProducer waits for pending messages of the producer to be delivered until ctx is done,
+// and returns how many are left.
+func (a *App) flushProducer(ctx context.Context) int {
+	pending := a.kafkaProducer.Len()
+	for pending > 0 && ctx.Err() == nil {
+		timeout := 100 * time.Millisecond
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = min(timeout, time.Until(deadline))
+		}
+		pending = a.kafkaProducer.Flush(max(int(timeout.Milliseconds()), 1))
+	}
+	return pending
+}
+
+// waitFor calls stop and waits for it to return until ctx is done.
+func waitFor(ctx context.Context, stop func()) error {
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeClients closes the Kafka clients that are still open.
+func (a *App) closeClients() error {
+	var err error
+	if a.replayConsumer != nil && !a.replayConsumer.IsClosed() {
+		err = a.replayConsumer.Close()
+	}
+	if a.kafkaConsumer != nil && !a.kafkaConsumer.IsClosed() {
+		err = errors.Join(err, a.kafkaConsumer.Close())
+	}
 	if a.kafkaProducer != nil && !a.kafkaProducer.IsClosed() {
 		a.kafkaProducer.Close()
 	}
+	return err
+}
 
-	// Stop HTTP server
-	return a.server.Shutdown(context.Background())
+// closeListener releases the address of the application, even if it never served requests.
+func (a *App) closeListener() {
+	if a.listener != nil {
+		_ = a.listener.Close()
+	}
+}
+
+// metadataClient is a Kafka client able to request cluster metadata.
+type metadataClient interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+}
+
+// kafkaCheck checks that Kafka brokers answer metadata requests of kafkaClient.
+func kafkaCheck(kafkaClient metadataClient) controller.HealthCheck {
+	return func(ctx context.Context) error {
+		timeout := controller.DefaultHealthCheckTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		_, err := kafkaClient.GetMetadata(nil, false, max(int(timeout.Milliseconds()), 1))
+		return err
+	}
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
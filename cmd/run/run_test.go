@@ -0,0 +1,297 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	server "github.com/microcks/microcks-testcontainers-go-demo/cmd/run"
+	app "github.com/microcks/microcks-testcontainers-go-demo/internal"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubPastryAPI knows a single available pastry.
+type stubPastryAPI struct{}
+
+var millefeuille = client.Pastry{Name: "Millefeuille", Size: "L", Price: model.NewMoney(440, model.USD), Status: "available"}
+
+func (stubPastryAPI) GetPastry(_ context.Context, name string) (client.Pastry, error) {
+	if name != millefeuille.Name {
+		return client.Pastry{}, &client.NotFoundError{Name: name}
+	}
+	return millefeuille, nil
+}
+
+func (stubPastryAPI) ListPastries(_ context.Context, _ string) ([]client.Pastry, error) {
+	return []client.Pastry{millefeuille}, nil
+}
+
+func (stubPastryAPI) UpdatePastry(_ context.Context, _ string, _ client.PastryUpdate) (client.Pastry, error) {
+	return millefeuille, nil
+}
+
+// stubPublisher records published events.
+type stubPublisher struct {
+	mu     sync.Mutex
+	events []*model.OrderEvent
+}
+
+func (s *stubPublisher) PublishOrderEvent(_ context.Context, event *model.OrderEvent) (*model.OrderEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return event, nil
+}
+
+// stubListener pretends to consume reviews, or fails to start with err.
+type stubListener struct {
+	err error
+}
+
+func (s *stubListener) Listen(_ context.Context) (<-chan struct{}, error) {
+	return make(chan struct{}), s.err
+}
+
+func (s *stubListener) Stop() {}
+
+func (s *stubListener) Running() bool {
+	return s.err == nil
+}
+
+func withStubListener(listener *stubListener) server.Option {
+	return server.WithOrderEventListener(func(_ service.OrderService) service.OrderEventListener {
+		return listener
+	})
+}
+
+func TestNewApplicationReturnsKafkaErrors(t *testing.T) {
+	_, err := server.NewApplication(&app.ApplicationProperties{KafkaConfigMap: &kafka.ConfigMap{}})
+	assert.ErrorContains(t, err, "bootstrap.servers")
+
+	_, err = server.NewApplication(&app.ApplicationProperties{KafkaConfigMap: &kafka.ConfigMap{
+		"bootstrap.servers": "localhost:9092",
+		"group.id":          "order-service",
+		"unknown.property":  "value",
+	}})
+	assert.ErrorContains(t, err, "failed to create Kafka consumer")
+}
+
+func TestNewApplicationConfiguresProducerLikeConsumer(t *testing.T) {
+	// Security settings of the application are applied to the producer.
+	_, err := server.NewApplication(&app.ApplicationProperties{KafkaConfigMap: &kafka.ConfigMap{
+		"bootstrap.servers": "localhost:9092",
+		"group.id":          "order-service",
+		"security.protocol": "SASL_SSL",
+		"sasl.mechanism":    "UNKNOWN",
+	}}, withStubListener(&stubListener{}))
+	assert.ErrorContains(t, err, "failed to create Kafka producer")
+
+	// Consumer settings are not.
+	application, err := server.NewApplication(&app.ApplicationProperties{HTTPAddr: "127.0.0.1:0", KafkaConfigMap: &kafka.ConfigMap{
+		"bootstrap.servers":               "localhost:9092",
+		"group.id":                        "order-service",
+		"auto.offset.reset":               "latest",
+		"go.application.rebalance.enable": true,
+		"security.protocol":               "SASL_PLAINTEXT",
+		"sasl.mechanism":                  "PLAIN",
+		"sasl.username":                   "order-service",
+		"sasl.password":                   "secret",
+	}})
+	require.NoError(t, err)
+	assert.NoError(t, application.Stop(context.Background()))
+}
+
+func TestNewApplicationWithOptions(t *testing.T) {
+	publisher := &stubPublisher{}
+	repository := service.NewInMemoryOrderRepository()
+	application, err := server.NewApplication(&app.ApplicationProperties{HTTPAddr: "127.0.0.1:0"},
+		server.WithPastryAPI(stubPastryAPI{}),
+		server.WithOrderEventPublisher(publisher),
+		withStubListener(&stubListener{}),
+		server.WithOrderRepository(repository),
+		server.WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Middleware", "outer")
+				next.ServeHTTP(w, r)
+			})
+		}),
+		server.WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Middleware", "inner")
+				next.ServeHTTP(w, r)
+			})
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = application.Stop(context.Background()) })
+
+	recorder := httptest.NewRecorder()
+	application.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/orders",
+		strings.NewReader(`{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1}],"totalPrice":4.4}`)))
+	require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+	assert.Equal(t, []string{"outer", "inner"}, recorder.Header().Values("X-Middleware"))
+
+	require.Len(t, publisher.events, 1)
+	orderID := publisher.events[0].Order.ID
+	assert.NotNil(t, repository.Get(orderID))
+	assert.Equal(t, repository.Get(orderID), application.AppService.OrderService.GetOrder(orderID))
+
+	// Replaced Kafka components are not checked.
+	recorder = httptest.NewRecorder()
+	application.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status":"UP","components":{"orderListener":{"status":"UP"},"pastryAPI":{"status":"UP"}}}`, recorder.Body.String())
+}
+
+func TestStartReturnsListenerError(t *testing.T) {
+	application, err := server.NewApplication(&app.ApplicationProperties{HTTPAddr: "127.0.0.1:0"},
+		server.WithPastryAPI(stubPastryAPI{}),
+		server.WithOrderEventPublisher(&stubPublisher{}),
+		withStubListener(&stubListener{err: errors.New("no broker")}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = application.Stop(context.Background()) })
+
+	err = application.Start(context.Background())
+	assert.ErrorContains(t, err, "no broker")
+	assert.False(t, application.Ready())
+}
+
+// newStubApplication creates an application listening on addr, with Kafka components replaced.
+func newStubApplication(t *testing.T, addr string) (*server.App, error) {
+	application, err := server.NewApplication(&app.ApplicationProperties{HTTPAddr: addr},
+		server.WithPastryAPI(stubPastryAPI{}),
+		server.WithOrderEventPublisher(&stubPublisher{}),
+		withStubListener(&stubListener{}),
+	)
+	if err == nil {
+		t.Cleanup(func() { _ = application.Stop(context.Background()) })
+	}
+	return application, err
+}
+
+func TestApplicationsListenOnEphemeralPorts(t *testing.T) {
+	first, err := newStubApplication(t, "127.0.0.1:0")
+	require.NoError(t, err)
+	second, err := newStubApplication(t, "127.0.0.1:0")
+	require.NoError(t, err)
+
+	firstPort := first.Addr().(*net.TCPAddr).Port
+	assert.NotZero(t, firstPort)
+	assert.NotEqual(t, firstPort, second.Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, "http://"+first.Addr().String(), first.BaseURL())
+
+	for _, application := range []*server.App{first, second} {
+		go func() {
+			_ = application.Start(context.Background())
+		}()
+		resp, err := http.Get(application.BaseURL() + "/healthz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestNewApplicationReturnsListenError(t *testing.T) {
+	first, err := newStubApplication(t, "127.0.0.1:0")
+	require.NoError(t, err)
+
+	_, err = newStubApplication(t, first.Addr().String())
+	assert.ErrorContains(t, err, "failed to listen on "+first.Addr().String())
+}
+
+func TestBaseURLOnAllInterfaces(t *testing.T) {
+	application, err := newStubApplication(t, ":0")
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://localhost:"+strconv.Itoa(application.Addr().(*net.TCPAddr).Port), application.BaseURL())
+}
+
+// blockingReplayer replays orders once release is closed.
+type blockingReplayer struct {
+	release chan struct{}
+}
+
+func (b *blockingReplayer) Replay(ctx context.Context) (int, error) {
+	select {
+	case <-b.release:
+		return 0, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestStartServesProbesWhileReplaying(t *testing.T) {
+	replayer := &blockingReplayer{release: make(chan struct{})}
+	application, err := server.NewApplication(&app.ApplicationProperties{HTTPAddr: "127.0.0.1:0"},
+		server.WithPastryAPI(stubPastryAPI{}),
+		server.WithOrderEventPublisher(&stubPublisher{}),
+		withStubListener(&stubListener{}),
+		server.WithOrderEventReplayer(func(_ service.OrderService) service.OrderEventReplayer { return replayer }),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = application.Stop(context.Background()) })
+	go func() {
+		_ = application.Start(context.Background())
+	}()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(application.BaseURL() + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	postOrder := func() *http.Response {
+		resp, err := http.Post(application.BaseURL()+"/api/orders", "application/json",
+			strings.NewReader(`{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1}],"totalPrice":4.4}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// Process is alive while orders are being rebuilt, but neither ready nor serving orders.
+	status, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	status, body := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, `"orderReplay":{"status":"DOWN","error":"orders are being rebuilt"}`)
+	resp := postOrder()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+	assert.False(t, application.Ready())
+
+	close(replayer.release)
+	require.Eventually(t, application.Ready, 5*time.Second, 10*time.Millisecond)
+	status, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusCreated, postOrder().StatusCode)
+}
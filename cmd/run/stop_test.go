@@ -0,0 +1,215 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	server "github.com/microcks/microcks-testcontainers-go-demo/cmd/run"
+	app "github.com/microcks/microcks-testcontainers-go-demo/internal"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	createdTopic  = "orders-created"
+	reviewedTopic = "orders-reviewed"
+)
+
+// blockingPastryAPI holds pastry lookups, signalling them on started, until release is closed.
+type blockingPastryAPI struct {
+	stubPastryAPI
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingPastryAPI) GetPastry(ctx context.Context, name string) (client.Pastry, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.stubPastryAPI.GetPastry(ctx, name)
+}
+
+// newKafkaApplication creates an application using Kafka topics of an in-process mock cluster.
+func newKafkaApplication(t *testing.T, opts ...server.Option) (*server.App, *kafka.MockCluster) {
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	require.NoError(t, cluster.CreateTopic(createdTopic, 1, 1))
+	require.NoError(t, cluster.CreateTopic(reviewedTopic, 1, 1))
+
+	application, err := server.NewApplication(&app.ApplicationProperties{
+		OrderEventsCreatedTopic:  createdTopic,
+		OrderEventsReviewedTopic: reviewedTopic,
+		HTTPAddr:                 "127.0.0.1:0",
+		KafkaConfigMap: &kafka.ConfigMap{
+			"bootstrap.servers": cluster.BootstrapServers(),
+			"group.id":          "order-service",
+			"auto.offset.reset": "earliest",
+		},
+	}, opts...)
+	require.NoError(t, err)
+
+	go func() {
+		_ = application.Start(context.Background())
+	}()
+	require.Eventually(t, application.Ready, 5*time.Second, 10*time.Millisecond)
+	return application, cluster
+}
+
+func TestStopDrainsRequestsAndDeliversTheirEvents(t *testing.T) {
+	pastryAPI := &blockingPastryAPI{started: make(chan struct{}), release: make(chan struct{})}
+	application, cluster := newKafkaApplication(t, server.WithPastryAPI(pastryAPI))
+
+	// Orders are in flight when the application is stopped.
+	const orders = 5
+	statuses := make(chan int, orders)
+	for range orders {
+		go func() {
+			resp, err := http.Post(application.BaseURL()+"/api/orders", "application/json",
+				strings.NewReader(`{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1}],"totalPrice":4.4}`))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	for range orders {
+		<-pastryAPI.started
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stopped := make(chan error)
+	go func() {
+		stopped <- application.Stop(ctx)
+	}()
+
+	// New requests are refused while in-flight ones complete.
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(application.BaseURL() + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	close(pastryAPI.release)
+	for range orders {
+		assert.Equal(t, http.StatusCreated, <-statuses)
+	}
+	require.NoError(t, <-stopped)
+
+	// Every created order has its event.
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cluster.BootstrapServers(),
+		"group.id":          "reviewer",
+		"auto.offset.reset": "earliest",
+	})
+	require.NoError(t, err)
+	defer consumer.Close()
+	require.NoError(t, consumer.Subscribe(createdTopic, nil))
+	ids := map[string]bool{}
+	for range orders {
+		message, err := consumer.ReadMessage(10 * time.Second)
+		require.NoError(t, err)
+		var event model.OrderEvent
+		require.NoError(t, json.Unmarshal(message.Value, &event))
+		assert.Equal(t, "Creation", event.ChangeReason)
+		ids[event.Order.ID] = true
+	}
+	assert.Len(t, ids, orders)
+}
+
+func TestStopCommitsProcessedReviews(t *testing.T) {
+	application, cluster := newKafkaApplication(t, server.WithPastryAPI(stubPastryAPI{}))
+
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": cluster.BootstrapServers(), "go.delivery.reports": false})
+	require.NoError(t, err)
+	defer producer.Close()
+	const reviews = 3
+	topic := reviewedTopic
+	for i := range reviews {
+		review, err := json.Marshal(model.OrderEvent{
+			Timestamp:    time.Now().UnixMilli(),
+			Order:        model.Order{OrderInfo: model.OrderInfo{CustomerID: "lbroudoux"}, ID: fmt.Sprintf("order-%d", i), Status: model.VALIDATED},
+			ChangeReason: "Review",
+		})
+		require.NoError(t, err)
+		require.NoError(t, producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          review,
+		}, nil))
+	}
+	require.Zero(t, producer.Flush(5000))
+	require.Eventually(t, func() bool {
+		return application.AppService.OrderService.GetOrder(fmt.Sprintf("order-%d", reviews-1)) != nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, application.Stop(ctx))
+
+	// A restarted application would resume after the processed reviews.
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cluster.BootstrapServers(),
+		"group.id":          "order-service",
+	})
+	require.NoError(t, err)
+	defer consumer.Close()
+	committed, err := consumer.Committed([]kafka.TopicPartition{{Topic: &topic, Partition: 0}}, 5000)
+	require.NoError(t, err)
+	require.Len(t, committed, 1)
+	assert.Equal(t, kafka.Offset(reviews), committed[0].Offset)
+}
+
+func TestStopReturnsWhenDeadlineExceeded(t *testing.T) {
+	pastryAPI := &blockingPastryAPI{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(pastryAPI.release)
+	application, err := server.NewApplication(&app.ApplicationProperties{HTTPAddr: "127.0.0.1:0"},
+		server.WithPastryAPI(pastryAPI),
+		server.WithOrderEventPublisher(&stubPublisher{}),
+		withStubListener(&stubListener{}),
+	)
+	require.NoError(t, err)
+	go func() {
+		_ = application.Start(context.Background())
+	}()
+	require.Eventually(t, application.Ready, 5*time.Second, 10*time.Millisecond)
+
+	go func() {
+		resp, err := http.Post(application.BaseURL()+"/api/orders", "application/json",
+			strings.NewReader(`{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1}],"totalPrice":4.4}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-pastryAPI.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = application.Stop(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "failed to drain in-flight requests")
+}
@@ -14,12 +14,42 @@
 
 package internal
 
-import "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// DefaultApplicationPort is the port the API listens on by default.
+const DefaultApplicationPort = 9000
+
+// DefaultHTTPAddr returns the address the API listens on by default, on DefaultApplicationPort.
+func DefaultHTTPAddr() string {
+	return ":" + strconv.Itoa(DefaultApplicationPort)
+}
 
 // ApplicationProperties represents application wide properties.
 type ApplicationProperties struct {
 	PastriesBaseURL          string
 	OrderEventsCreatedTopic  string
 	OrderEventsReviewedTopic string
-	KafkaConfigMap           *kafka.ConfigMap
+	// OrderEventsFailedTopic receives events failing orders not reviewed in time, so that
+	// reviewers of OrderEventsCreatedTopic do not get them. Empty publishes them on
+	// OrderEventsCreatedTopic.
+	OrderEventsFailedTopic string
+	// KafkaConfigMap configures the Kafka consumer, including its SASL and TLS settings. The
+	// producer uses the same configuration, except consumer properties.
+	KafkaConfigMap *kafka.ConfigMap
+	// HTTPAddr is the address the API listens on, DefaultHTTPAddr() if empty. Port 0 picks a free port.
+	HTTPAddr string
+	// ReplayOrderEvents rebuilds orders from order events topics before serving requests.
+	ReplayOrderEvents bool
+	// OrderReviewSLA is the duration after which orders not reviewed yet fail. Zero disables it.
+	OrderReviewSLA time.Duration
+	// OTLPEndpoint is the OTLP/HTTP endpoint traces are exported to. Empty disables export.
+	OTLPEndpoint string
+	// Logger is injected in every component. Nil means slog.Default().
+	Logger *slog.Logger
 }
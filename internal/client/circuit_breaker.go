@@ -0,0 +1,121 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when a call is rejected because the Pastry API circuit breaker is open.
+var ErrCircuitOpen = errors.New("pastry API circuit breaker is open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker counts consecutive failures and short-circuits calls once a threshold is reached.
+// After openDuration, a single trial call is let through: its success closes the circuit again,
+// its failure re-opens it for another openDuration.
+type circuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+
+	mu        sync.Mutex
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+	trialSent bool
+}
+
+func newCircuitBreaker(failureThreshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+	}
+}
+
+// allow tells if a call may be attempted, returning ErrCircuitOpen otherwise.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.openDuration {
+			return ErrCircuitOpen
+		}
+		cb.state = circuitHalfOpen
+		cb.trialSent = true
+		return nil
+	case circuitHalfOpen:
+		if cb.trialSent {
+			return ErrCircuitOpen
+		}
+		cb.trialSent = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// remaining tells how long the circuit will stay open, 0 if it is not.
+func (cb *circuitBreaker) remaining() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != circuitOpen {
+		return 0
+	}
+	return max(cb.openDuration-time.Since(cb.openedAt), 0)
+}
+
+// success records a successful call and closes the circuit.
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = circuitClosed
+	cb.failures = 0
+	cb.trialSent = false
+}
+
+// release gives back a trial call that ended without telling anything about the Pastry API.
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitHalfOpen {
+		cb.trialSent = false
+	}
+}
+
+// failure records a failed call and opens the circuit when threshold is reached.
+func (cb *circuitBreaker) failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.failureThreshold {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		cb.trialSent = false
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrNotModified is returned by conditional calls when the pastry still matches the given ETag.
+var ErrNotModified = errors.New("pastry not modified")
+
+// ErrPreconditionFailed is returned by conditional updates when the pastry no longer matches
+// the given ETag.
+var ErrPreconditionFailed = errors.New("pastry changed since it was read")
+
+// NotFoundError is returned when the Pastry API does not know the requested pastry.
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return "pastry " + e.Name + " not found"
+}
+
+// UnavailableError is returned when the Pastry API cannot be reached, answers with
+// a server error or is short-circuited by the circuit breaker.
+type UnavailableError struct {
+	// StatusCode is the HTTP status returned by the Pastry API, 0 if no response was received.
+	StatusCode int
+	// RetryAfter is a hint on when the Pastry API may be available again, 0 if unknown.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *UnavailableError) Error() string {
+	return "pastry API unavailable: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError is returned when a Pastry API response cannot be understood.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "failed to decode response body: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the Pastry API answers with an unexpected status.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// unavailableResponse builds an UnavailableError from a 5xx response, honouring its Retry-After header.
+func unavailableResponse(resp *http.Response) *UnavailableError {
+	err := &UnavailableError{
+		StatusCode: resp.StatusCode,
+		Err:        &StatusError{StatusCode: resp.StatusCode},
+	}
+	if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && seconds > 0 {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
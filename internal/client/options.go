@@ -0,0 +1,77 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
+)
+
+const (
+	// DefaultTimeout is the per-call timeout applied when none is configured.
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetryBackoff is the base backoff between two retries when none is configured.
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Option allows customizing a PastryAPI client built with NewPastryAPIClient.
+type Option func(*pastryAPIClient)
+
+// WithHTTPClient sets the http.Client used for calling the Pastry API.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *pastryAPIClient) {
+		if httpClient != nil {
+			c.httpClient = httpClient
+		}
+	}
+}
+
+// WithTimeout sets the maximum duration of a single call attempt to the Pastry API.
+// A zero or negative value disables the per-call timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *pastryAPIClient) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries enables retrying calls failing with a network error or a 5xx status.
+// Retries are spaced by an exponential backoff starting at backoff, with jitter.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *pastryAPIClient) {
+		c.maxRetries = max(maxRetries, 0)
+		if backoff > 0 {
+			c.retryBackoff = backoff
+		}
+	}
+}
+
+// WithCircuitBreaker enables a circuit breaker that opens after failureThreshold
+// consecutive failed calls and rejects calls with ErrCircuitOpen during openDuration.
+func WithCircuitBreaker(failureThreshold int, openDuration time.Duration) Option {
+	return func(c *pastryAPIClient) {
+		if failureThreshold > 0 {
+			c.breaker = newCircuitBreaker(failureThreshold, openDuration)
+		}
+	}
+}
+
+// WithMetrics sets the collectors observing calls to the Pastry API.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(c *pastryAPIClient) {
+		c.metrics = m
+	}
+}
@@ -15,74 +15,297 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
 )
 
 type Pastry struct {
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Size        string  `json:"size"`
-	Price       float32 `json:"price"`
-	Status      string  `json:"status"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Size        string      `json:"size"`
+	Price       model.Money `json:"price"`
+	Status      string      `json:"status"`
+	// Stock is the quantity left in stock, nil if the Pastry API does not track it.
+	Stock *int32 `json:"stock,omitempty"`
+}
+
+// PastryUpdate holds the pastry fields to change, nil fields being left untouched.
+type PastryUpdate struct {
+	Description *string      `json:"description,omitempty"`
+	Size        *string      `json:"size,omitempty"`
+	Price       *model.Money `json:"price,omitempty"`
+	Status      *string      `json:"status,omitempty"`
+	Stock       *int32       `json:"stock,omitempty"`
+	// IfMatch makes the update conditional: it fails with ErrPreconditionFailed if the
+	// pastry no longer matches this ETag.
+	IfMatch string `json:"-"`
 }
 
 type PastryAPI interface {
-	GetPastry(name string) (Pastry, error)
-	ListPastries(size string) ([]Pastry, error)
+	GetPastry(ctx context.Context, name string) (Pastry, error)
+	ListPastries(ctx context.Context, size string) ([]Pastry, error)
+	UpdatePastry(ctx context.Context, name string, update PastryUpdate) (Pastry, error)
+}
+
+// ConditionalPastryAPI is implemented by PastryAPI clients able to revalidate a pastry
+// previously fetched with an ETag.
+type ConditionalPastryAPI interface {
+	// GetPastryIfNoneMatch gets a pastry and its ETag, or returns ErrNotModified if the
+	// pastry still matches etag. An empty etag always gets the pastry.
+	GetPastryIfNoneMatch(ctx context.Context, name string, etag string) (Pastry, string, error)
 }
 
 type pastryAPIClient struct {
-	baseURL string
+	baseURL      string
+	httpClient   *http.Client
+	timeout      time.Duration
+	maxRetries   int
+	retryBackoff time.Duration
+	breaker      *circuitBreaker
+	metrics      *metrics.Metrics
 }
 
-func NewPastryAPIClient(baseURL string) PastryAPI {
-	return &pastryAPIClient{
-		baseURL: baseURL,
+func NewPastryAPIClient(baseURL string, opts ...Option) PastryAPI {
+	c := &pastryAPIClient{
+		baseURL:      baseURL,
+		httpClient:   http.DefaultClient,
+		timeout:      DefaultTimeout,
+		retryBackoff: DefaultRetryBackoff,
+		metrics:      metrics.New(nil),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
-func (c *pastryAPIClient) GetPastry(name string) (Pastry, error) {
+func (c *pastryAPIClient) GetPastry(ctx context.Context, name string) (Pastry, error) {
+	pastry, _, err := c.GetPastryIfNoneMatch(ctx, name, "")
+	return pastry, err
+}
+
+func (c *pastryAPIClient) GetPastryIfNoneMatch(ctx context.Context, name string, etag string) (Pastry, string, error) {
 	url := c.baseURL + "/pastries/" + name
 
-	resp, err := http.Get(url)
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+
+	var pastry Pastry
+	var newETag string
+	err := c.do(ctx, "GetPastry", http.MethodGet, url, header, nil, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusNotModified {
+			return ErrNotModified
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return &NotFoundError{Name: name}
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &StatusError{StatusCode: resp.StatusCode}
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&pastry); err != nil {
+			return &DecodeError{Err: err}
+		}
+		newETag = resp.Header.Get("ETag")
+		return nil
+	})
 	if err != nil {
-		return Pastry{}, fmt.Errorf("failed to make GET request: %w", err)
+		return Pastry{}, "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return Pastry{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	return pastry, newETag, nil
+}
+
+func (c *pastryAPIClient) ListPastries(ctx context.Context, size string) ([]Pastry, error) {
+	url := c.baseURL + "/pastries?size=" + size
+
+	var pastries []Pastry
+	err := c.do(ctx, "ListPastries", http.MethodGet, url, nil, nil, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return &StatusError{StatusCode: resp.StatusCode}
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&pastries); err != nil {
+			return &DecodeError{Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pastries, nil
+}
+
+func (c *pastryAPIClient) UpdatePastry(ctx context.Context, name string, update PastryUpdate) (Pastry, error) {
+	url := c.baseURL + "/pastries/" + name
+
+	body, err := json.Marshal(update)
+	if err != nil {
+		return Pastry{}, fmt.Errorf("failed to encode request body: %w", err)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if update.IfMatch != "" {
+		header.Set("If-Match", update.IfMatch)
 	}
 
 	var pastry Pastry
-	err = json.NewDecoder(resp.Body).Decode(&pastry)
+	err = c.do(ctx, "UpdatePastry", http.MethodPatch, url, header, body, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			return ErrPreconditionFailed
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return &NotFoundError{Name: name}
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &StatusError{StatusCode: resp.StatusCode}
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&pastry); err != nil {
+			return &DecodeError{Err: err}
+		}
+		return nil
+	})
 	if err != nil {
-		return Pastry{}, fmt.Errorf("failed to decode response body: %w", err)
+		return Pastry{}, err
 	}
 
 	return pastry, nil
 }
 
-func (c *pastryAPIClient) ListPastries(size string) ([]Pastry, error) {
-	url := c.baseURL + "/pastries?size=" + size
+// do calls the Pastry API for operation, retrying on network errors and 5xx responses
+// if the request can safely be sent again, and hands the final response over to handle.
+// Calls are rejected with an UnavailableError wrapping ErrCircuitOpen while the circuit
+// breaker is open. Cancelling ctx aborts the call and its pending retries.
+func (c *pastryAPIClient) do(ctx context.Context, operation, method, url string, header http.Header, body []byte, handle func(*http.Response) error) (err error) {
+	start := time.Now()
+	defer func() {
+		c.metrics.PastryAPIRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		if kind := errorKind(err); kind != "" {
+			c.metrics.PastryAPIErrors.WithLabelValues(operation, kind).Inc()
+		}
+	}()
+
+	if c.breaker != nil {
+		if err := c.breaker.allow(); err != nil {
+			return &UnavailableError{RetryAfter: c.breaker.remaining(), Err: err}
+		}
+	}
+
+	var retryable bool
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(c.backoff(attempt))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		retryable, err = c.attempt(ctx, method, url, header, body, handle)
+		if !retryable || !canRetry(method, header) {
+			break
+		}
+	}
+
+	if c.breaker != nil {
+		switch {
+		case ctx.Err() != nil:
+			// Abandoned by the caller, this says nothing about the Pastry API health.
+			c.breaker.release()
+		case retryable:
+			c.breaker.failure()
+		default:
+			c.breaker.success()
+		}
+	}
+	return err
+}
+
+// canRetry tells if a request can be sent again after its response was lost. Other requests
+// than reads may have been applied, so they are only retried if they are conditional: a
+// replay of an applied update then fails its precondition instead of being applied twice.
+func canRetry(method string, header http.Header) bool {
+	return method == http.MethodGet || method == http.MethodHead || header.Get("If-Match") != ""
+}
 
-	resp, err := http.Get(url)
+// attempt performs a single call and tells if its error is worth a retry.
+func (c *pastryAPIClient) attempt(ctx context.Context, method, url string, header http.Header, body []byte, handle func(*http.Response) error) (bool, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return false, fmt.Errorf("failed to create %s request: %w", method, err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	tracing.InjectHTTP(ctx, req.Header)
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make GET request: %w", err)
+		return true, &UnavailableError{Err: fmt.Errorf("failed to make %s request: %w", method, err)}
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return true, unavailableResponse(resp)
 	}
+	return false, handle(resp)
+}
 
-	var pastries []Pastry
-	err = json.NewDecoder(resp.Body).Decode(&pastries)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode response body: %w", err)
+// errorKind classifies err for metrics. Answers telling that a pastry is unknown, unchanged
+// or changed by someone else are not errors.
+func errorKind(err error) string {
+	var notFoundErr *NotFoundError
+	var unavailableErr *UnavailableError
+	var statusErr *StatusError
+	var decodeErr *DecodeError
+	switch {
+	case err == nil, errors.Is(err, ErrNotModified), errors.Is(err, ErrPreconditionFailed), errors.As(err, &notFoundErr):
+		return ""
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case errors.As(err, &unavailableErr):
+		return "unavailable"
+	case errors.As(err, &statusErr):
+		return "status"
+	case errors.As(err, &decodeErr):
+		return "decode"
+	default:
+		return "other"
 	}
+}
 
-	return pastries, nil
+// backoff computes the delay before a retry: exponential on attempt, with jitter
+// picked in the upper half so that concurrent callers do not retry in lockstep.
+func (c *pastryAPIClient) backoff(attempt int) time.Duration {
+	delay := c.retryBackoff << (attempt - 1)
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int64N(half+1))
 }
@@ -0,0 +1,267 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+const millefeuilleJSON = `{"name":"Millefeuille","description":"Delicieux Millefeuille pas calorique du tout","size":"L","price":4.4,"status":"available"}`
+
+// faultyServer starts a local Pastry API that answers with the given faults
+// (HTTP status codes) before serving a regular pastry.
+func faultyServer(t *testing.T, delay time.Duration, faults ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1))
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if call <= len(faults) {
+			w.WriteHeader(faults[call-1])
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(millefeuilleJSON))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestGetPastryRetriesOnServerErrors(t *testing.T) {
+	ctx := context.Background()
+	server, calls := faultyServer(t, 0, http.StatusServiceUnavailable, http.StatusBadGateway)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithRetries(2, time.Millisecond))
+
+	pastry, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, "Millefeuille", pastry.Name)
+	require.Equal(t, int32(3), calls.Load())
+}
+
+func TestGetPastryGivesUpAfterRetries(t *testing.T) {
+	ctx := context.Background()
+	server, calls := faultyServer(t, 0, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithRetries(1, time.Millisecond))
+
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.Error(t, err)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestUpdatePastryIsNotRetried(t *testing.T) {
+	ctx := context.Background()
+	server, calls := faultyServer(t, 0, http.StatusServiceUnavailable)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithRetries(2, time.Millisecond))
+
+	stock := int32(3)
+	_, err := pastryAPIClient.UpdatePastry(ctx, "Millefeuille", client.PastryUpdate{Stock: &stock})
+	var unavailableErr *client.UnavailableError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestUpdatePastryIsConditional(t *testing.T) {
+	ctx := context.Background()
+	var ifMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		switch len(ifMatch) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusPreconditionFailed)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(millefeuilleJSON))
+		}
+	}))
+	t.Cleanup(server.Close)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithRetries(2, time.Millisecond))
+
+	// Conditional updates can be retried as a replay cannot be applied twice.
+	stock := int32(3)
+	_, err := pastryAPIClient.UpdatePastry(ctx, "Millefeuille", client.PastryUpdate{Stock: &stock, IfMatch: `"v1"`})
+	require.ErrorIs(t, err, client.ErrPreconditionFailed)
+	require.Equal(t, []string{`"v1"`, `"v1"`}, ifMatch)
+
+	_, err = pastryAPIClient.UpdatePastry(ctx, "Millefeuille", client.PastryUpdate{Stock: &stock, IfMatch: `"v2"`})
+	require.NoError(t, err)
+}
+
+func TestGetPastryDoesNotRetryClientErrors(t *testing.T) {
+	ctx := context.Background()
+	server, calls := faultyServer(t, 0, http.StatusNotFound)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithRetries(3, time.Millisecond))
+
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	var notFoundErr *client.NotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+	require.Equal(t, "Millefeuille", notFoundErr.Name)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestGetPastryUnavailableError(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "12")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL)
+
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	var unavailableErr *client.UnavailableError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, http.StatusServiceUnavailable, unavailableErr.StatusCode)
+	require.Equal(t, 12*time.Second, unavailableErr.RetryAfter)
+
+	// Network failures are outages too.
+	server.Close()
+	_, err = pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, 0, unavailableErr.StatusCode)
+}
+
+func TestGetPastryDecodeError(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name": "Millefeuille", `))
+	}))
+	t.Cleanup(server.Close)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL)
+
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	var decodeErr *client.DecodeError
+	require.ErrorAs(t, err, &decodeErr)
+}
+
+func TestGetPastryTimeout(t *testing.T) {
+	ctx := context.Background()
+	server, _ := faultyServer(t, time.Second)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestGetPastryWithCustomHTTPClient(t *testing.T) {
+	ctx := context.Background()
+	server, _ := faultyServer(t, 0)
+
+	var roundTrips atomic.Int32
+	httpClient := &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			roundTrips.Add(1)
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithHTTPClient(httpClient))
+
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), roundTrips.Load())
+}
+
+func TestGetPastryCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	server, calls := faultyServer(t, 0, http.StatusInternalServerError, http.StatusInternalServerError)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithCircuitBreaker(2, 100*time.Millisecond))
+
+	// Two consecutive failures open the circuit.
+	for range 2 {
+		_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+		require.Error(t, err)
+		require.NotErrorIs(t, err, client.ErrCircuitOpen)
+	}
+
+	// Calls are now rejected without reaching the server.
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.ErrorIs(t, err, client.ErrCircuitOpen)
+	var unavailableErr *client.UnavailableError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Positive(t, unavailableErr.RetryAfter)
+	require.Equal(t, int32(2), calls.Load())
+
+	// Once open duration has elapsed, a trial call goes through and closes the circuit.
+	time.Sleep(150 * time.Millisecond)
+	pastry, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, "Millefeuille", pastry.Name)
+
+	_, err = pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, int32(4), calls.Load())
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGetPastryCancellationStopsRetries(t *testing.T) {
+	server, calls := faultyServer(t, 0, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithRetries(3, time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestGetPastryMetrics(t *testing.T) {
+	ctx := context.Background()
+	m := metrics.New(prometheus.NewRegistry())
+	server, _ := faultyServer(t, 0, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusNotFound)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL, client.WithRetries(1, time.Millisecond), client.WithMetrics(m))
+
+	_, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.Error(t, err)
+	_, err = pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	var notFoundErr *client.NotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+	_, err = pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+
+	// Unknown pastries are answers, not errors.
+	require.InDelta(t, 1, testutil.ToFloat64(m.PastryAPIErrors.WithLabelValues("GetPastry", "unavailable")), 0)
+	require.Equal(t, 1, testutil.CollectAndCount(m.PastryAPIErrors))
+	require.Equal(t, 1, testutil.CollectAndCount(m.PastryAPIRequestDuration))
+}
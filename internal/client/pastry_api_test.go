@@ -16,9 +16,14 @@ package client_test
 
 import (
 	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	microcks "microcks.io/testcontainers-go"
@@ -49,17 +54,17 @@ func TestGetPastry(t *testing.T) {
 	require.NoError(t, err)
 	pastryAPIClient := client.NewPastryAPIClient(baseAPIURL)
 
-	pastry, err := pastryAPIClient.GetPastry("Millefeuille")
+	pastry, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
 	require.NoError(t, err)
 	require.Equal(t, "Millefeuille", pastry.Name)
 	require.Equal(t, "available", pastry.Status)
 
-	pastry, err = pastryAPIClient.GetPastry("Eclair Cafe")
+	pastry, err = pastryAPIClient.GetPastry(ctx, "Eclair Cafe")
 	require.NoError(t, err)
 	require.Equal(t, "Eclair Cafe", pastry.Name)
 	require.Equal(t, "available", pastry.Status)
 
-	pastry, err = pastryAPIClient.GetPastry("Eclair Chocolat")
+	pastry, err = pastryAPIClient.GetPastry(ctx, "Eclair Chocolat")
 	require.NoError(t, err)
 	require.Equal(t, "Eclair Chocolat", pastry.Name)
 	require.Equal(t, "unknown", pastry.Status)
@@ -82,15 +87,15 @@ func TestListPastries(t *testing.T) {
 	beforeMockInvocations, err := microcksContainer.ServiceInvocationsCount(ctx, "API Pastries", "0.0.1")
 	require.NoError(t, err)
 
-	pastries, err := pastryAPIClient.ListPastries("S")
+	pastries, err := pastryAPIClient.ListPastries(ctx, "S")
 	require.NoError(t, err)
 	assert.Len(t, pastries, 1)
 
-	pastries, err = pastryAPIClient.ListPastries("M")
+	pastries, err = pastryAPIClient.ListPastries(ctx, "M")
 	require.NoError(t, err)
 	assert.Len(t, pastries, 2)
 
-	pastries, err = pastryAPIClient.ListPastries("L")
+	pastries, err = pastryAPIClient.ListPastries(ctx, "L")
 	require.NoError(t, err)
 	assert.Len(t, pastries, 2)
 
@@ -99,3 +104,87 @@ func TestListPastries(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 3, afterMockInvocations-beforeMockInvocations)
 }
+
+func TestGetPastryWithResilienceOptions(t *testing.T) {
+	ctx := context.Background()
+	microcksContainer := setup(ctx, t)
+
+	baseAPIURL, err := microcksContainer.RestMockEndpoint(ctx, "API Pastries", "0.0.1")
+	require.NoError(t, err)
+	pastryAPIClient := client.NewPastryAPIClient(baseAPIURL,
+		client.WithHTTPClient(&http.Client{}),
+		client.WithTimeout(2*time.Second),
+		client.WithRetries(2, 50*time.Millisecond),
+		client.WithCircuitBreaker(3, time.Second),
+	)
+
+	// Get the number of invocations before our test.
+	beforeMockInvocations, err := microcksContainer.ServiceInvocationsCount(ctx, "API Pastries", "0.0.1")
+	require.NoError(t, err)
+
+	pastry, err := pastryAPIClient.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, "Millefeuille", pastry.Name)
+
+	pastries, err := pastryAPIClient.ListPastries(ctx, "M")
+	require.NoError(t, err)
+	assert.Len(t, pastries, 2)
+
+	// Successful calls must not have been retried.
+	afterMockInvocations, err := microcksContainer.ServiceInvocationsCount(ctx, "API Pastries", "0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, 2, afterMockInvocations-beforeMockInvocations)
+}
+
+func TestUpdatePastry(t *testing.T) {
+	ctx := context.Background()
+	microcksContainer := setup(ctx, t)
+
+	baseAPIURL, err := microcksContainer.RestMockEndpoint(ctx, "API Pastries", "0.0.1")
+	require.NoError(t, err)
+	pastryAPIClient := client.NewPastryAPIClient(baseAPIURL)
+
+	// Get the number of invocations before our test.
+	beforeMockInvocations, err := microcksContainer.ServiceInvocationsCount(ctx, "API Pastries", "0.0.1")
+	require.NoError(t, err)
+
+	price := model.NewMoney(260, model.USD)
+	pastry, err := pastryAPIClient.UpdatePastry(ctx, "Eclair Cafe", client.PastryUpdate{Price: &price})
+	require.NoError(t, err)
+	require.Equal(t, "Eclair Cafe", pastry.Name)
+	require.Equal(t, price, pastry.Price)
+
+	// Check our mock API has been invoked the correct number of times.
+	afterMockInvocations, err := microcksContainer.ServiceInvocationsCount(ctx, "API Pastries", "0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, 1, afterMockInvocations-beforeMockInvocations)
+}
+
+func TestUpdatePastrySendsPartialPayload(t *testing.T) {
+	ctx := context.Background()
+
+	var receivedMethod, receivedBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receivedMethod, receivedBody = r.Method, string(body)
+		if r.URL.Path != "/pastries/Eclair Cafe" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"Eclair Cafe","size":"M","price":2.5,"status":"out_of_stock"}`))
+	}))
+	t.Cleanup(server.Close)
+	pastryAPIClient := client.NewPastryAPIClient(server.URL)
+
+	status := "out_of_stock"
+	pastry, err := pastryAPIClient.UpdatePastry(ctx, "Eclair Cafe", client.PastryUpdate{Status: &status})
+	require.NoError(t, err)
+	require.Equal(t, "out_of_stock", pastry.Status)
+	require.Equal(t, http.MethodPatch, receivedMethod)
+	require.JSONEq(t, `{"status":"out_of_stock"}`, receivedBody)
+
+	_, err = pastryAPIClient.UpdatePastry(ctx, "Paris Brest", client.PastryUpdate{Status: &status})
+	var notFoundErr *client.NotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+}
@@ -0,0 +1,251 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheTTL is the default duration a pastry is served from cache.
+	DefaultCacheTTL = 30 * time.Second
+	// DefaultNegativeCacheTTL is the default duration an unknown pastry is remembered as such.
+	DefaultNegativeCacheTTL = 10 * time.Second
+	// DefaultCacheMaxEntries is the default maximum number of cached pastries.
+	DefaultCacheMaxEntries = 1000
+)
+
+// CacheStats holds counters of a CachedPastryAPI.
+type CacheStats struct {
+	// Hits counts lookups served from a fresh entry.
+	Hits int64
+	// Misses counts lookups that had to call the Pastry API.
+	Misses int64
+	// Revalidations counts stale entries confirmed by the Pastry API with a 304.
+	Revalidations int64
+	// StaleHits counts stale entries served because the Pastry API failed.
+	StaleHits int64
+	// Evictions counts entries removed to respect the size bound.
+	Evictions int64
+}
+
+// CachedPastryAPI is a PastryAPI that caches pastry lookups.
+type CachedPastryAPI interface {
+	PastryAPI
+	// Stats returns a snapshot of cache counters.
+	Stats() CacheStats
+}
+
+// CacheOption allows customizing a CachedPastryAPI built with NewCachedPastryAPI.
+type CacheOption func(*cachedPastryAPI)
+
+// WithCacheTTL sets how long a pastry is served from cache before being revalidated.
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(c *cachedPastryAPI) {
+		c.ttl = ttl
+	}
+}
+
+// WithNegativeCacheTTL sets how long an unknown pastry is remembered as such.
+func WithNegativeCacheTTL(ttl time.Duration) CacheOption {
+	return func(c *cachedPastryAPI) {
+		c.negativeTTL = ttl
+	}
+}
+
+// WithCacheMaxEntries bounds the number of cached pastries, least recently used ones being evicted first.
+func WithCacheMaxEntries(maxEntries int) CacheOption {
+	return func(c *cachedPastryAPI) {
+		if maxEntries > 0 {
+			c.maxEntries = maxEntries
+		}
+	}
+}
+
+// WithStaleIfError allows serving an expired pastry for up to staleTTL after its
+// expiry when the Pastry API cannot be reached.
+func WithStaleIfError(staleTTL time.Duration) CacheOption {
+	return func(c *cachedPastryAPI) {
+		c.staleTTL = staleTTL
+	}
+}
+
+// WithCacheClock sets the function used to get current time.
+func WithCacheClock(now func() time.Time) CacheOption {
+	return func(c *cachedPastryAPI) {
+		if now != nil {
+			c.now = now
+		}
+	}
+}
+
+type cacheEntry struct {
+	name      string
+	pastry    Pastry
+	etag      string
+	notFound  bool
+	expiresAt time.Time
+}
+
+type cachedPastryAPI struct {
+	next        PastryAPI
+	ttl         time.Duration
+	negativeTTL time.Duration
+	staleTTL    time.Duration
+	maxEntries  int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+// NewCachedPastryAPI decorates next with a cache of pastry lookups. If next implements
+// ConditionalPastryAPI, expired entries are revalidated using their ETag.
+// Pastry lists are not cached.
+func NewCachedPastryAPI(next PastryAPI, opts ...CacheOption) CachedPastryAPI {
+	c := &cachedPastryAPI{
+		next:        next,
+		ttl:         DefaultCacheTTL,
+		negativeTTL: DefaultNegativeCacheTTL,
+		maxEntries:  DefaultCacheMaxEntries,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *cachedPastryAPI) GetPastry(ctx context.Context, name string) (Pastry, error) {
+	c.mu.Lock()
+	entry, found := c.lookup(name)
+	if found && c.now().Before(entry.expiresAt) {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return entry.result()
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	var pastry Pastry
+	var etag string
+	var err error
+	if conditional, ok := c.next.(ConditionalPastryAPI); ok {
+		staleETag := ""
+		if found && !entry.notFound {
+			staleETag = entry.etag
+		}
+		pastry, etag, err = conditional.GetPastryIfNoneMatch(ctx, name, staleETag)
+	} else {
+		pastry, err = c.next.GetPastry(ctx, name)
+	}
+
+	var notFoundErr *NotFoundError
+	switch {
+	case err == nil:
+		c.store(&cacheEntry{name: name, pastry: pastry, etag: etag, expiresAt: c.now().Add(c.ttl)})
+		return pastry, nil
+	case errors.Is(err, ErrNotModified) && found:
+		c.mu.Lock()
+		c.stats.Revalidations++
+		c.mu.Unlock()
+		c.store(&cacheEntry{name: name, pastry: entry.pastry, etag: entry.etag, expiresAt: c.now().Add(c.ttl)})
+		return entry.pastry, nil
+	case errors.As(err, &notFoundErr):
+		c.store(&cacheEntry{name: name, notFound: true, expiresAt: c.now().Add(c.negativeTTL)})
+		return Pastry{}, err
+	}
+
+	// Pastry API is failing, serve the stale entry if it is not too old.
+	var unavailableErr *UnavailableError
+	if found && errors.As(err, &unavailableErr) && c.now().Before(entry.expiresAt.Add(c.staleTTL)) {
+		c.mu.Lock()
+		c.stats.StaleHits++
+		c.mu.Unlock()
+		return entry.result()
+	}
+	return Pastry{}, err
+}
+
+func (c *cachedPastryAPI) ListPastries(ctx context.Context, size string) ([]Pastry, error) {
+	return c.next.ListPastries(ctx, size)
+}
+
+// UpdatePastry updates the pastry and evicts it from cache, whatever the outcome.
+func (c *cachedPastryAPI) UpdatePastry(ctx context.Context, name string, update PastryUpdate) (Pastry, error) {
+	defer c.evict(name)
+	return c.next.UpdatePastry(ctx, name, update)
+}
+
+func (c *cachedPastryAPI) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// lookup returns a copy of the entry for name. Must be called with mu held.
+func (c *cachedPastryAPI) lookup(name string) (cacheEntry, bool) {
+	element, ok := c.entries[name]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.lru.MoveToFront(element)
+	return *element.Value.(*cacheEntry), true
+}
+
+// store adds or replaces an entry, evicting the least recently used ones above maxEntries.
+func (c *cachedPastryAPI) store(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.name]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[entry.name] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).name)
+		c.stats.Evictions++
+	}
+}
+
+// evict removes the entry for name, if any.
+func (c *cachedPastryAPI) evict(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[name]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, name)
+	}
+}
+
+func (e *cacheEntry) result() (Pastry, error) {
+	if e.notFound {
+		return Pastry{}, &NotFoundError{Name: e.name}
+	}
+	return e.pastry, nil
+}
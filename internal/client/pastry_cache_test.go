@@ -0,0 +1,183 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// etagServer starts a local Pastry API knowing only Millefeuille and Eclair Cafe, and
+// supporting If-None-Match. It fails with 503 while down is set.
+func etagServer(t *testing.T) (*httptest.Server, *atomic.Int32, *atomic.Bool) {
+	t.Helper()
+
+	var calls atomic.Int32
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/pastries/")
+		if name != "Millefeuille" && name != "Eclair Cafe" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := `"` + strings.ReplaceAll(name, " ", "-") + `-v1"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"` + name + `","size":"L","price":4.4,"status":"available"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls, &down
+}
+
+func TestCachedPastryAPIHitsAndRevalidation(t *testing.T) {
+	ctx := context.Background()
+	server, calls, _ := etagServer(t)
+	clock := &fakeClock{now: time.Now()}
+	cachedAPI := client.NewCachedPastryAPI(client.NewPastryAPIClient(server.URL),
+		client.WithCacheTTL(time.Minute), client.WithCacheClock(clock.Now))
+
+	for range 3 {
+		pastry, err := cachedAPI.GetPastry(ctx, "Millefeuille")
+		require.NoError(t, err)
+		require.Equal(t, "Millefeuille", pastry.Name)
+	}
+	require.Equal(t, int32(1), calls.Load())
+	require.Equal(t, client.CacheStats{Hits: 2, Misses: 1}, cachedAPI.Stats())
+
+	// Once expired, the entry is revalidated with its ETag.
+	clock.Advance(2 * time.Minute)
+	pastry, err := cachedAPI.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, "Millefeuille", pastry.Name)
+	require.Equal(t, int32(2), calls.Load())
+	require.Equal(t, client.CacheStats{Hits: 2, Misses: 2, Revalidations: 1}, cachedAPI.Stats())
+
+	// And fresh again.
+	_, err = cachedAPI.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestCachedPastryAPINegativeCaching(t *testing.T) {
+	ctx := context.Background()
+	server, calls, _ := etagServer(t)
+	clock := &fakeClock{now: time.Now()}
+	cachedAPI := client.NewCachedPastryAPI(client.NewPastryAPIClient(server.URL),
+		client.WithNegativeCacheTTL(10*time.Second), client.WithCacheClock(clock.Now))
+
+	for range 2 {
+		_, err := cachedAPI.GetPastry(ctx, "Paris Brest")
+		var notFoundErr *client.NotFoundError
+		require.ErrorAs(t, err, &notFoundErr)
+	}
+	require.Equal(t, int32(1), calls.Load())
+
+	clock.Advance(11 * time.Second)
+	_, err := cachedAPI.GetPastry(ctx, "Paris Brest")
+	require.Error(t, err)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestCachedPastryAPIStaleIfError(t *testing.T) {
+	ctx := context.Background()
+	server, _, down := etagServer(t)
+	clock := &fakeClock{now: time.Now()}
+	cachedAPI := client.NewCachedPastryAPI(client.NewPastryAPIClient(server.URL),
+		client.WithCacheTTL(time.Minute), client.WithStaleIfError(5*time.Minute), client.WithCacheClock(clock.Now))
+
+	_, err := cachedAPI.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+
+	// Pastry API is down: the stale entry is served within the stale window.
+	down.Store(true)
+	clock.Advance(3 * time.Minute)
+	pastry, err := cachedAPI.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, "Millefeuille", pastry.Name)
+	require.Equal(t, int64(1), cachedAPI.Stats().StaleHits)
+
+	// But not beyond.
+	clock.Advance(5 * time.Minute)
+	_, err = cachedAPI.GetPastry(ctx, "Millefeuille")
+	var unavailableErr *client.UnavailableError
+	require.ErrorAs(t, err, &unavailableErr)
+
+	// Nor for pastries that were never fetched.
+	_, err = cachedAPI.GetPastry(ctx, "Eclair Cafe")
+	require.ErrorAs(t, err, &unavailableErr)
+}
+
+func TestCachedPastryAPIMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	server, calls, _ := etagServer(t)
+	cachedAPI := client.NewCachedPastryAPI(client.NewPastryAPIClient(server.URL), client.WithCacheMaxEntries(2))
+
+	for _, name := range []string{"Millefeuille", "Eclair Cafe", "Paris Brest"} {
+		_, _ = cachedAPI.GetPastry(ctx, name)
+	}
+	require.Equal(t, int64(1), cachedAPI.Stats().Evictions)
+
+	// Millefeuille was the least recently used and has been evicted.
+	_, err := cachedAPI.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, int32(4), calls.Load())
+}
+
+func TestCachedPastryAPIEvictsUpdatedPastry(t *testing.T) {
+	ctx := context.Background()
+	server, calls, _ := etagServer(t)
+	cachedAPI := client.NewCachedPastryAPI(client.NewPastryAPIClient(server.URL))
+
+	_, err := cachedAPI.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+
+	status := "out_of_stock"
+	_, _ = cachedAPI.UpdatePastry(ctx, "Millefeuille", client.PastryUpdate{Status: &status})
+
+	// Next lookup must reach the Pastry API again.
+	_, err = cachedAPI.GetPastry(ctx, "Millefeuille")
+	require.NoError(t, err)
+	require.Equal(t, int32(3), calls.Load())
+}
@@ -0,0 +1,299 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config loads the configuration of the order service from a YAML file, environment
+// variables and command-line flags.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	app "github.com/microcks/microcks-testcontainers-go-demo/internal"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv is the environment variable giving the configuration file, unless -config is set.
+const FileEnv = "CONFIG_FILE"
+
+// kafkaEnvPrefix prefixes environment variables passed to Kafka clients, such as
+// KAFKA_PROP_SECURITY_PROTOCOL for security.protocol. It is longer than KAFKA_ so that
+// variables of Kubernetes service links (KAFKA_PORT) or images (KAFKA_HOME), which are not
+// Kafka properties, do not make clients fail.
+const kafkaEnvPrefix = "KAFKA_PROP_"
+
+// Config holds all application configuration.
+type Config struct {
+	PastryAPIURL  string        `yaml:"pastryApiUrl"`
+	HTTPAddr      string        `yaml:"httpAddr"`
+	OrdersTopic   string        `yaml:"ordersTopic"`
+	ReviewedTopic string        `yaml:"reviewedTopic"`
+	FailedTopic   string        `yaml:"failedTopic"`
+	ReplayOrders  bool          `yaml:"replayOrders"`
+	ReviewSLA     time.Duration `yaml:"reviewSla"`
+	OTLPEndpoint  string        `yaml:"otlpEndpoint"`
+	LogLevel      string        `yaml:"logLevel"`
+	LogFormat     string        `yaml:"logFormat"`
+	// Kafka holds the librdkafka properties of Kafka clients, such as bootstrap.servers.
+	Kafka map[string]string `yaml:"kafka"`
+}
+
+// Default returns the configuration binding the application to the services of the
+// microcks-docker-compose.yml file.
+func Default() *Config {
+	return &Config{
+		PastryAPIURL:  "http://localhost:9090/rest/API+Pastries/0.0.1",
+		HTTPAddr:      app.DefaultHTTPAddr(),
+		OrdersTopic:   "orders-created",
+		ReviewedTopic: "OrderEventsAPI-0.1.0-orders-reviewed",
+		FailedTopic:   "orders-failed",
+		ReviewSLA:     15 * time.Minute,
+		LogLevel:      "info",
+		LogFormat:     logging.FormatText,
+		Kafka: map[string]string{
+			"bootstrap.servers": "localhost:9092",
+			"group.id":          "order-service",
+			"auto.offset.reset": "latest",
+		},
+	}
+}
+
+// setting is a configuration value that can be set from an environment variable and a flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+	// isBool allows the flag to be set without value.
+	isBool bool
+}
+
+func stringSetting(env, flag, usage string, field func(c *Config) *string) setting {
+	return setting{env: env, flag: flag, usage: usage, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+var settings = []setting{
+	stringSetting("PASTRY_API_URL", "pastry-api-url", "base URL of the Pastry API",
+		func(c *Config) *string { return &c.PastryAPIURL }),
+	stringSetting("HTTP_ADDR", "http-addr", "address the API listens on, port 0 picking a free port",
+		func(c *Config) *string { return &c.HTTPAddr }),
+	stringSetting("ORDERS_TOPIC", "orders-topic", "topic order events are published on",
+		func(c *Config) *string { return &c.OrdersTopic }),
+	stringSetting("REVIEWED_TOPIC", "reviewed-topic", "topic orders reviews are consumed from",
+		func(c *Config) *string { return &c.ReviewedTopic }),
+	stringSetting("FAILED_TOPIC", "failed-topic", "topic review timeouts are published on, orders topic if empty",
+		func(c *Config) *string { return &c.FailedTopic }),
+	{env: "REPLAY_ORDERS_ON_STARTUP", flag: "replay-orders", usage: "rebuild orders from order events on startup",
+		set: func(c *Config, value string) (err error) {
+			c.ReplayOrders, err = strconv.ParseBool(value)
+			return err
+		}, isBool: true},
+	{env: "ORDER_REVIEW_SLA", flag: "review-sla", usage: "duration after which orders not reviewed fail, 0 to disable",
+		set: func(c *Config, value string) (err error) {
+			c.ReviewSLA, err = time.ParseDuration(value)
+			return err
+		}},
+	stringSetting("OTEL_EXPORTER_OTLP_ENDPOINT", "otlp-endpoint", "OTLP/HTTP endpoint traces are exported to",
+		func(c *Config) *string { return &c.OTLPEndpoint }),
+	stringSetting("LOG_LEVEL", "log-level", "minimum level of logs: debug, info, warn or error",
+		func(c *Config) *string { return &c.LogLevel }),
+	stringSetting("LOG_FORMAT", "log-format", "format of logs: text or json",
+		func(c *Config) *string { return &c.LogFormat }),
+	{env: "KAFKA_BOOTSTRAP_URL", flag: "kafka-bootstrap", usage: "Kafka bootstrap servers",
+		set: func(c *Config, value string) error {
+			c.Kafka["bootstrap.servers"] = value
+			return nil
+		}},
+}
+
+// Load builds the configuration from defaults, then the YAML file, the environment and the
+// command-line args, each one overriding the previous one. environ is formatted as by
+// os.Environ. Every invalid value is reported in the returned error.
+func Load(args []string, environ []string) (*Config, error) {
+	env := map[string]string{}
+	for _, variable := range environ {
+		if key, value, ok := strings.Cut(variable, "="); ok {
+			env[key] = value
+		}
+	}
+
+	// Flags are applied last, once the file they may point to is read.
+	var applyFlags []func(c *Config) error
+	fs := flag.NewFlagSet("order-service", flag.ContinueOnError)
+	configFile := fs.String("config", env[FileEnv], "YAML configuration file")
+	for _, s := range settings {
+		apply := func(value string) error {
+			applyFlags = append(applyFlags, func(c *Config) error {
+				if err := s.set(c, value); err != nil {
+					return fmt.Errorf("invalid flag -%s: %w", s.flag, err)
+				}
+				return nil
+			})
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.flag, s.usage, apply)
+		} else {
+			fs.Func(s.flag, s.usage, apply)
+		}
+	}
+	fs.Func("kafka", "Kafka client property as key=value, may be repeated", func(property string) error {
+		key, value, ok := strings.Cut(property, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expecting key=value, got %q", property)
+		}
+		applyFlags = append(applyFlags, func(c *Config) error {
+			c.Kafka[key] = value
+			return nil
+		})
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := Default()
+	if *configFile != "" {
+		if err := config.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if value, ok := env[s.env]; ok {
+			if err := s.set(config, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", s.env, err))
+			}
+		}
+	}
+	var kafkaKeys []string
+	for key := range env {
+		if _, ok := kafkaProperty(key); ok {
+			kafkaKeys = append(kafkaKeys, key)
+		}
+	}
+	slices.Sort(kafkaKeys)
+	for _, key := range kafkaKeys {
+		property, _ := kafkaProperty(key)
+		config.Kafka[property] = env[key]
+	}
+	for _, apply := range applyFlags {
+		if err := apply(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, config.Validate())
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// kafkaProperty returns the Kafka property passed by the environment variable key, such as
+// sasl.mechanism for KAFKA_PROP_SASL_MECHANISM. Double underscores stand for underscores, as
+// in KAFKA_PROP_LOG__LEVEL for log_level.
+func kafkaProperty(key string) (string, bool) {
+	if !strings.HasPrefix(key, kafkaEnvPrefix) || len(key) == len(kafkaEnvPrefix) {
+		return "", false
+	}
+	words := strings.Split(strings.ToLower(strings.TrimPrefix(key, kafkaEnvPrefix)), "__")
+	for i, word := range words {
+		words[i] = strings.ReplaceAll(word, "_", ".")
+	}
+	return strings.Join(words, "_"), true
+}
+
+// readFile overrides the configuration with the one of the YAML file at path. Unknown keys
+// are reported as they are likely typos.
+func (c *Config) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration, reporting all invalid values at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if pastryAPIURL, err := url.Parse(c.PastryAPIURL); err != nil || (pastryAPIURL.Scheme != "http" && pastryAPIURL.Scheme != "https") || pastryAPIURL.Host == "" {
+		errs = append(errs, fmt.Errorf("pastry API URL %q is not an http(s) URL", c.PastryAPIURL))
+	}
+	if _, port, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("HTTP address %q is not a host:port address: %w", c.HTTPAddr, err))
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("HTTP address %q has an invalid port", c.HTTPAddr))
+	}
+	if c.OrdersTopic == "" {
+		errs = append(errs, errors.New("orders topic is empty"))
+	}
+	if c.ReviewedTopic == "" {
+		errs = append(errs, errors.New("reviewed topic is empty"))
+	}
+	if c.ReviewSLA < 0 {
+		errs = append(errs, fmt.Errorf("review SLA %s is negative", c.ReviewSLA))
+	}
+	if c.OTLPEndpoint != "" {
+		if endpoint, err := url.Parse(c.OTLPEndpoint); err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			errs = append(errs, fmt.Errorf("OTLP endpoint %q is not a URL", c.OTLPEndpoint))
+		}
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if c.LogFormat != logging.FormatText && c.LogFormat != logging.FormatJSON {
+		errs = append(errs, fmt.Errorf("unknown log format %q, expecting %s or %s", c.LogFormat, logging.FormatText, logging.FormatJSON))
+	}
+	for _, property := range []string{"bootstrap.servers", "group.id"} {
+		if c.Kafka[property] == "" {
+			errs = append(errs, fmt.Errorf("no %s specified for Kafka", property))
+		}
+	}
+	if err := validateKafkaProperties(c.Kafka); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, validateKafkaSecurity(c.Kafka)...)
+	return errors.Join(errs...)
+}
+
+// KafkaConfigMap returns the configuration of Kafka clients.
+func (c *Config) KafkaConfigMap() *kafka.ConfigMap {
+	configMap := kafka.ConfigMap{}
+	for key, value := range c.Kafka {
+		configMap[key] = value
+	}
+	return &configMap
+}
@@ -0,0 +1,159 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFile writes a configuration file for the test and returns its path.
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := config.Load(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, config.Default(), cfg)
+	assert.Equal(t, &kafka.ConfigMap{
+		"bootstrap.servers": "localhost:9092",
+		"group.id":          "order-service",
+		"auto.offset.reset": "latest",
+	}, cfg.KafkaConfigMap())
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, `
+pastryApiUrl: http://pastries:8080/api
+httpAddr: ":8000"
+ordersTopic: file-orders
+reviewSla: 1h
+logFormat: json
+kafka:
+  bootstrap.servers: file-kafka:9092
+  group.id: file-group
+  enable.auto.commit: false
+`)
+
+	// The file overrides defaults, the environment overrides the file and flags override
+	// the environment.
+	cfg, err := config.Load(
+		[]string{"-http-addr", "127.0.0.1:0", "-replay-orders", "-kafka", "client.id=flag-client"},
+		[]string{
+			config.FileEnv + "=" + path,
+			"HTTP_ADDR=:7000",
+			"ORDERS_TOPIC=env-orders",
+			"KAFKA_BOOTSTRAP_URL=env-kafka:9092",
+			"KAFKA_PROP_SECURITY_PROTOCOL=SSL",
+			"KAFKA_PROP_CLIENT_ID=env-client",
+		})
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://pastries:8080/api", cfg.PastryAPIURL)
+	assert.Equal(t, "127.0.0.1:0", cfg.HTTPAddr)
+	assert.Equal(t, "env-orders", cfg.OrdersTopic)
+	assert.Equal(t, "OrderEventsAPI-0.1.0-orders-reviewed", cfg.ReviewedTopic)
+	assert.True(t, cfg.ReplayOrders)
+	assert.Equal(t, time.Hour, cfg.ReviewSLA)
+	assert.Equal(t, "json", cfg.LogFormat)
+	assert.Equal(t, map[string]string{
+		"bootstrap.servers":  "env-kafka:9092",
+		"group.id":           "file-group",
+		"auto.offset.reset":  "latest",
+		"enable.auto.commit": "false",
+		"security.protocol":  "SSL",
+		"client.id":          "flag-client",
+	}, cfg.Kafka)
+}
+
+func TestLoadConfigFlagOverridesFileEnv(t *testing.T) {
+	path := writeFile(t, "ordersTopic: flag-file-orders\n")
+	cfg, err := config.Load([]string{"-config", path}, []string{config.FileEnv + "=missing.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, "flag-file-orders", cfg.OrdersTopic)
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	_, err := config.Load(
+		[]string{"-replay-orders=maybe", "-pastry-api-url", "pastries"},
+		[]string{
+			"ORDER_REVIEW_SLA=15 minutes",
+			"REVIEWED_TOPIC=",
+			"LOG_LEVEL=verbose",
+			"LOG_FORMAT=xml",
+			"HTTP_ADDR=9000",
+			"KAFKA_PROP_GROUP_ID=",
+		})
+	require.Error(t, err)
+	for _, problem := range []string{
+		"invalid ORDER_REVIEW_SLA",
+		"invalid flag -replay-orders",
+		`pastry API URL "pastries"`,
+		"reviewed topic is empty",
+		"verbose",
+		`unknown log format "xml"`,
+		`HTTP address "9000"`,
+		"no group.id specified for Kafka",
+	} {
+		assert.ErrorContains(t, err, problem)
+	}
+}
+
+func TestLoadRejectsUnknownFileKeys(t *testing.T) {
+	path := writeFile(t, "orderTopic: typo\n")
+	_, err := config.Load([]string{"-config", path}, nil)
+	assert.ErrorContains(t, err, "field orderTopic not found")
+}
+
+func TestLoadTakesOnlyPrefixedKafkaVariables(t *testing.T) {
+	// Variables of Kubernetes service links and images are not Kafka properties.
+	cfg, err := config.Load(nil, []string{
+		"KAFKA_PORT=tcp://10.0.0.1:9092",
+		"KAFKA_SERVICE_HOST=10.0.0.1",
+		"KAFKA_HOME=/opt/kafka",
+		"KAFKA_PROP_CLIENT_ID=order-service",
+	})
+	require.NoError(t, err)
+	assert.Len(t, cfg.Kafka, len(config.Default().Kafka)+1)
+	assert.Equal(t, "order-service", cfg.Kafka["client.id"])
+
+	_, err = config.Load(nil, []string{"KAFKA_PROP_SERVICE_HOST=10.0.0.1"})
+	assert.ErrorContains(t, err, `invalid Kafka properties: No such configuration property: "service.host"`)
+}
+
+func TestLoadKafkaPropertiesWithUnderscores(t *testing.T) {
+	cfg, err := config.Load(nil, []string{"KAFKA_PROP_LOG__LEVEL=3", "KAFKA_PROP_ENABLED__EVENTS=0"})
+	require.NoError(t, err)
+	assert.Equal(t, "3", cfg.Kafka["log_level"])
+	assert.Equal(t, "0", cfg.Kafka["enabled_events"])
+}
+
+func TestLoadRejectsInvalidKafkaProperties(t *testing.T) {
+	_, err := config.Load([]string{"-kafka", "client.idd=typo"}, nil)
+	assert.ErrorContains(t, err, `invalid Kafka properties: No such configuration property: "client.idd"`)
+
+	_, err = config.Load([]string{"-kafka", "session.timeout.ms=soon"}, nil)
+	assert.ErrorContains(t, err, `invalid Kafka properties: Invalid value for configuration property "session.timeout.ms"`)
+}
@@ -0,0 +1,114 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// saslMechanisms are the SASL mechanisms Kafka clients of the application can authenticate with.
+var saslMechanisms = []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512", "OAUTHBEARER"}
+
+// validateKafkaProperties reports properties Kafka clients do not know or whose value is
+// invalid, as told by librdkafka when creating a consumer, closed right away. The consumer
+// connects to no broker and does not set security up, which validateKafkaSecurity checks.
+func validateKafkaProperties(properties map[string]string) error {
+	configMap := kafka.ConfigMap{}
+	for key, value := range properties {
+		configMap[key] = value
+	}
+	delete(configMap, "bootstrap.servers")
+	configMap["security.protocol"] = "plaintext"
+	// An empty group, already reported, would never let the consumer close.
+	configMap["group.id"] = "order-service-validation"
+	// Notices about the missing brokers are not logged.
+	configMap["log_level"] = 0
+
+	consumer, err := kafka.NewConsumer(&configMap)
+	if err != nil {
+		return fmt.Errorf("invalid Kafka properties: %w", err)
+	}
+	_ = consumer.Close()
+	return nil
+}
+
+// validateKafkaSecurity checks that the SASL and TLS properties of Kafka clients are complete.
+func validateKafkaSecurity(properties map[string]string) []error {
+	var errs []error
+	protocol := strings.ToLower(properties["security.protocol"])
+	switch protocol {
+	case "", "plaintext", "ssl":
+	case "sasl_plaintext", "sasl_ssl":
+		errs = append(errs, validateSASL(properties)...)
+	default:
+		errs = append(errs, fmt.Errorf("unknown Kafka security.protocol %q, expecting PLAINTEXT, SSL, SASL_PLAINTEXT or SASL_SSL", properties["security.protocol"]))
+	}
+
+	// TLS files are read when clients are created, checking them tells which one is missing.
+	for _, property := range []string{"ssl.ca.location", "ssl.certificate.location", "ssl.key.location"} {
+		location := properties[property]
+		if location == "" || (property == "ssl.ca.location" && location == "probe") {
+			continue
+		}
+		if _, err := os.Stat(location); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Kafka %s: %w", property, err))
+		}
+	}
+	return errs
+}
+
+// validateSASL checks the credentials required by the SASL mechanism.
+func validateSASL(properties map[string]string) []error {
+	mechanism := properties["sasl.mechanism"]
+	if mechanism == "" {
+		mechanism = properties["sasl.mechanisms"]
+	}
+	mechanism = strings.ToUpper(mechanism)
+	switch mechanism {
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		return requireProperties(properties, mechanism, "sasl.username", "sasl.password")
+	case "OAUTHBEARER":
+		// Tokens are not refreshed by the application, so they must come from an OIDC provider
+		// unless unsecured tokens are used for development.
+		if properties["enable.sasl.oauthbearer.unsecure.jwt"] == "true" {
+			return nil
+		}
+		if !strings.EqualFold(properties["sasl.oauthbearer.method"], "oidc") {
+			return []error{errors.New("sasl.oauthbearer.method=oidc is required by Kafka OAUTHBEARER")}
+		}
+		return requireProperties(properties, mechanism, "sasl.oauthbearer.client.id", "sasl.oauthbearer.client.secret",
+			"sasl.oauthbearer.token.endpoint.url")
+	case "":
+		return []error{fmt.Errorf("no sasl.mechanism specified for Kafka, expecting one of %s", strings.Join(saslMechanisms, ", "))}
+	default:
+		return []error{fmt.Errorf("unsupported Kafka sasl.mechanism %q, expecting one of %s", mechanism, strings.Join(saslMechanisms, ", "))}
+	}
+}
+
+// requireProperties reports the properties required by mechanism that are not set.
+func requireProperties(properties map[string]string, mechanism string, required ...string) []error {
+	var errs []error
+	for _, property := range required {
+		if properties[property] == "" {
+			errs = append(errs, fmt.Errorf("no %s specified for Kafka %s", property, mechanism))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,99 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"testing"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKafkaSecurity(t *testing.T) {
+	caLocation := writeFile(t, "-----BEGIN CERTIFICATE-----\n")
+	for name, environ := range map[string][]string{
+		"SCRAM over TLS": {
+			"KAFKA_PROP_SECURITY_PROTOCOL=SASL_SSL",
+			"KAFKA_PROP_SASL_MECHANISM=SCRAM-SHA-512",
+			"KAFKA_PROP_SASL_USERNAME=order-service",
+			"KAFKA_PROP_SASL_PASSWORD=secret",
+			"KAFKA_PROP_SSL_CA_LOCATION=" + caLocation,
+		},
+		"OAUTHBEARER with OIDC": {
+			"KAFKA_PROP_SECURITY_PROTOCOL=SASL_SSL",
+			"KAFKA_PROP_SASL_MECHANISM=OAUTHBEARER",
+			"KAFKA_PROP_SASL_OAUTHBEARER_METHOD=oidc",
+			"KAFKA_PROP_SASL_OAUTHBEARER_CLIENT_ID=order-service",
+			"KAFKA_PROP_SASL_OAUTHBEARER_CLIENT_SECRET=secret",
+			"KAFKA_PROP_SASL_OAUTHBEARER_TOKEN_ENDPOINT_URL=https://idp/token",
+		},
+		"mutual TLS": {
+			"KAFKA_PROP_SECURITY_PROTOCOL=SSL",
+			"KAFKA_PROP_SSL_CA_LOCATION=probe",
+			"KAFKA_PROP_SSL_CERTIFICATE_LOCATION=" + caLocation,
+			"KAFKA_PROP_SSL_KEY_LOCATION=" + caLocation,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := config.Load(nil, environ)
+			require.NoError(t, err)
+			// Security properties are passed to Kafka clients besides default ones.
+			assert.Len(t, *cfg.KafkaConfigMap(), len(config.Default().Kafka)+len(environ))
+		})
+	}
+}
+
+func TestLoadReportsIncompleteKafkaSecurity(t *testing.T) {
+	for name, test := range map[string]struct {
+		environ  []string
+		problems []string
+	}{
+		"unknown protocol": {
+			environ:  []string{"KAFKA_PROP_SECURITY_PROTOCOL=TLS"},
+			problems: []string{`unknown Kafka security.protocol "TLS"`},
+		},
+		"missing mechanism": {
+			environ:  []string{"KAFKA_PROP_SECURITY_PROTOCOL=SASL_SSL"},
+			problems: []string{"no sasl.mechanism specified for Kafka"},
+		},
+		"unsupported mechanism": {
+			environ:  []string{"KAFKA_PROP_SECURITY_PROTOCOL=SASL_PLAINTEXT", "KAFKA_PROP_SASL_MECHANISM=GSSAPI"},
+			problems: []string{`unsupported Kafka sasl.mechanism "GSSAPI"`},
+		},
+		"missing credentials": {
+			environ: []string{"KAFKA_PROP_SECURITY_PROTOCOL=SASL_SSL", "KAFKA_PROP_SASL_MECHANISM=PLAIN"},
+			problems: []string{
+				"no sasl.username specified for Kafka PLAIN",
+				"no sasl.password specified for Kafka PLAIN",
+			},
+		},
+		"OAUTHBEARER without OIDC": {
+			environ:  []string{"KAFKA_PROP_SECURITY_PROTOCOL=SASL_SSL", "KAFKA_PROP_SASL_MECHANISM=OAUTHBEARER"},
+			problems: []string{"sasl.oauthbearer.method=oidc is required"},
+		},
+		"missing TLS files": {
+			environ:  []string{"KAFKA_PROP_SECURITY_PROTOCOL=SSL", "KAFKA_PROP_SSL_CA_LOCATION=/missing/ca.pem"},
+			problems: []string{"invalid Kafka ssl.ca.location"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := config.Load(nil, test.environ)
+			for _, problem := range test.problems {
+				assert.ErrorContains(t, err, problem)
+			}
+		})
+	}
+}
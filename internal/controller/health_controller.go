@@ -0,0 +1,147 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHealthCheckTimeout is the default maximum duration of a component check.
+const DefaultHealthCheckTimeout = 2 * time.Second
+
+// Health statuses of the application and its components.
+const (
+	HealthUp   = "UP"
+	HealthDown = "DOWN"
+)
+
+// HealthCheck tells if a component can be used, returning an error describing why it cannot.
+type HealthCheck func(ctx context.Context) error
+
+type HealthController interface {
+	// Liveness tells that the process is up and able to answer.
+	Liveness(w http.ResponseWriter, r *http.Request)
+	// Readiness checks every component, answering 503 if one of them is down.
+	Readiness(w http.ResponseWriter, r *http.Request)
+}
+
+type healthController struct {
+	checks  map[string]HealthCheck
+	timeout time.Duration
+}
+
+// health is the body of health responses.
+type health struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components,omitempty"`
+}
+
+type componentHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CachedHealthCheck returns a check reusing the result of check for ttl, so that frequent
+// probes do not load the component. Concurrent probes wait for a single check.
+func CachedHealthCheck(check HealthCheck, ttl time.Duration) HealthCheck {
+	var (
+		mu        sync.Mutex
+		checkedAt time.Time
+		result    error
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return result
+		}
+		err := check(ctx)
+		// The probe giving up tells nothing about the component.
+		if ctx.Err() == nil {
+			checkedAt, result = time.Now(), err
+		}
+		return err
+	}
+}
+
+// HealthControllerOption allows customizing a HealthController built with NewHealthController.
+type HealthControllerOption func(*healthController)
+
+// WithHealthCheckTimeout sets the maximum duration of a component check.
+func WithHealthCheckTimeout(timeout time.Duration) HealthControllerOption {
+	return func(hc *healthController) {
+		hc.timeout = timeout
+	}
+}
+
+// NewHealthController creates a controller checking components readiness with checks, by name.
+func NewHealthController(checks map[string]HealthCheck, opts ...HealthControllerOption) HealthController {
+	hc := &healthController{
+		checks:  checks,
+		timeout: DefaultHealthCheckTimeout,
+	}
+	for _, opt := range opts {
+		opt(hc)
+	}
+	return hc
+}
+
+func (hc *healthController) Liveness(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, &health{Status: HealthUp})
+}
+
+// Readiness runs checks concurrently so that a slow component does not delay the others.
+func (hc *healthController) Readiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), hc.timeout)
+	defer cancel()
+
+	result := &health{Status: HealthUp, Components: make(map[string]componentHealth, len(hc.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range hc.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			component := componentHealth{Status: HealthUp}
+			if err := check(ctx); err != nil {
+				component = componentHealth{Status: HealthDown, Error: err.Error()}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			result.Components[name] = component
+			if component.Status == HealthDown {
+				result.Status = HealthDown
+			}
+		}()
+	}
+	wg.Wait()
+
+	writeHealth(w, result)
+}
+
+func writeHealth(w http.ResponseWriter, h *health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if h.Status == HealthUp {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(h)
+}
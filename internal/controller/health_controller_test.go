@@ -0,0 +1,101 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/controller"
+	"github.com/stretchr/testify/require"
+)
+
+func up(_ context.Context) error {
+	return nil
+}
+
+func TestLiveness(t *testing.T) {
+	healthController := controller.NewHealthController(map[string]controller.HealthCheck{
+		"kafka": func(_ context.Context) error { return errors.New("broker down") },
+	})
+
+	recorder := httptest.NewRecorder()
+	healthController.Liveness(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"status":"UP"}`, recorder.Body.String())
+}
+
+func TestReadiness(t *testing.T) {
+	healthController := controller.NewHealthController(map[string]controller.HealthCheck{
+		"kafka":     up,
+		"pastryAPI": up,
+	})
+
+	recorder := httptest.NewRecorder()
+	healthController.Readiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	require.JSONEq(t, `{"status":"UP","components":{"kafka":{"status":"UP"},"pastryAPI":{"status":"UP"}}}`, recorder.Body.String())
+}
+
+func TestReadinessReportsComponentsDown(t *testing.T) {
+	healthController := controller.NewHealthController(map[string]controller.HealthCheck{
+		"kafka":     up,
+		"pastryAPI": func(_ context.Context) error { return errors.New("connection refused") },
+		"orderListener": func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}, controller.WithHealthCheckTimeout(50*time.Millisecond))
+
+	recorder := httptest.NewRecorder()
+	healthController.Readiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.JSONEq(t, `{"status":"DOWN","components":{
+		"kafka":{"status":"UP"},
+		"pastryAPI":{"status":"DOWN","error":"connection refused"},
+		"orderListener":{"status":"DOWN","error":"context deadline exceeded"}
+	}}`, recorder.Body.String())
+}
+
+func TestCachedHealthCheck(t *testing.T) {
+	var calls int
+	failure := errors.New("connection refused")
+	check := controller.CachedHealthCheck(func(_ context.Context) error {
+		calls++
+		return failure
+	}, 50*time.Millisecond)
+
+	for range 3 {
+		require.ErrorIs(t, check(context.Background()), failure)
+	}
+	require.Equal(t, 1, calls)
+
+	time.Sleep(60 * time.Millisecond)
+	require.ErrorIs(t, check(context.Background()), failure)
+	require.Equal(t, 2, calls)
+
+	// Results of abandoned probes are not kept.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	time.Sleep(60 * time.Millisecond)
+	require.Error(t, check(ctx))
+	require.Error(t, check(context.Background()))
+	require.Equal(t, 4, calls)
+}
@@ -0,0 +1,212 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header making a request safe to retry.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for a retried request.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// DefaultIdempotencyTTL is the default duration during which a response is replayed.
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// DefaultIdempotencyMaxKeys is the default maximum number of remembered idempotency keys.
+	DefaultIdempotencyMaxKeys = 10000
+
+	// maxIdempotencyKeyLength is the maximum length of an idempotency key.
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyKeyReusedError is raised when a key is sent again with another request.
+type idempotencyKeyReusedError struct {
+	key string
+}
+
+func (e *idempotencyKeyReusedError) Error() string {
+	return "idempotency key " + e.key + " was already used for another request"
+}
+
+// idempotencyKeyInProgressError is raised when a key is sent again before the first
+// request has been processed.
+type idempotencyKeyInProgressError struct {
+	key string
+}
+
+func (e *idempotencyKeyInProgressError) Error() string {
+	return "request with idempotency key " + e.key + " is still in progress"
+}
+
+// idempotencyKeysExhaustedError is raised when no more idempotency keys can be remembered
+// because all of them belong to requests in progress.
+type idempotencyKeysExhaustedError struct{}
+
+func (e *idempotencyKeysExhaustedError) Error() string {
+	return "too many requests with idempotency keys in progress"
+}
+
+// storedResponse is a response to replay.
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (sr *storedResponse) write(w http.ResponseWriter) {
+	for name, values := range sr.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(sr.status)
+	_, _ = w.Write(sr.body)
+}
+
+// idempotencyKey is a key sent by a client, scoped to the route and the customer of the
+// request so that different clients picking the same key do not collide.
+type idempotencyKey struct {
+	route    string
+	customer string
+	key      string
+}
+
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	expiresAt   time.Time
+	// response is nil while the first request is in progress.
+	response *storedResponse
+}
+
+// idempotencyStore remembers responses by idempotency key, up to maxKeys of them.
+type idempotencyStore struct {
+	ttl     time.Duration
+	maxKeys int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[idempotencyKey]*idempotencyEntry
+	// completed holds keys of entries having a response, oldest first. As they all live
+	// for ttl, it is also their expiration order.
+	completed *list.List
+}
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{
+		ttl:       DefaultIdempotencyTTL,
+		maxKeys:   DefaultIdempotencyMaxKeys,
+		now:       time.Now,
+		entries:   make(map[idempotencyKey]*idempotencyEntry),
+		completed: list.New(),
+	}
+}
+
+// begin reserves key for a request whose body has fingerprint. It returns the response to
+// replay if the request has already been processed, nil if it must be processed, or an
+// error if key cannot be used for this request. When the store is full, the oldest
+// responses are forgotten first.
+func (s *idempotencyStore) begin(key idempotencyKey, fingerprint [sha256.Size]byte) (*storedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for s.completed.Len() > 0 && !now.Before(s.entries[s.completed.Front().Value.(idempotencyKey)].expiresAt) {
+		s.forgetOldest()
+	}
+
+	if entry, ok := s.entries[key]; ok {
+		switch {
+		case entry.fingerprint != fingerprint:
+			return nil, &idempotencyKeyReusedError{key: key.key}
+		case entry.response == nil:
+			return nil, &idempotencyKeyInProgressError{key: key.key}
+		default:
+			return entry.response, nil
+		}
+	}
+
+	for len(s.entries) >= s.maxKeys && s.completed.Len() > 0 {
+		s.forgetOldest()
+	}
+	if len(s.entries) >= s.maxKeys {
+		return nil, &idempotencyKeysExhaustedError{}
+	}
+	s.entries[key] = &idempotencyEntry{fingerprint: fingerprint}
+	return nil, nil
+}
+
+// complete stores the response of the request reserving key.
+func (s *idempotencyStore) complete(key idempotencyKey, response *storedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && entry.response == nil {
+		entry.response = response
+		entry.expiresAt = s.now().Add(s.ttl)
+		s.completed.PushBack(key)
+	}
+}
+
+// abort releases key so that the request can be retried.
+func (s *idempotencyStore) abort(key idempotencyKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && entry.response == nil {
+		delete(s.entries, key)
+	}
+}
+
+// forgetOldest removes the oldest completed entry. Must be called with mu held.
+func (s *idempotencyStore) forgetOldest() {
+	delete(s.entries, s.completed.Remove(s.completed.Front()).(idempotencyKey))
+}
+
+// responseRecorder writes a response while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(data)
+	return rr.ResponseWriter.Write(data)
+}
+
+// response copies the recorded response. The correlation ID is left out: replays carry the
+// one of the retry.
+func (rr *responseRecorder) response() *storedResponse {
+	header := rr.Header().Clone()
+	header.Del(logging.CorrelationIDHeader)
+	return &storedResponse{
+		status: rr.status,
+		header: header,
+		body:   bytes.Clone(rr.body.Bytes()),
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/controller"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/stretchr/testify/require"
+)
+
+// countingOrderService places orders with sequential IDs, or fails with err if set.
+func countingOrderService(calls *atomic.Int32, err error) *stubOrderService {
+	return &stubOrderService{placeOrder: func(info *model.OrderInfo) (*model.Order, error) {
+		n := calls.Add(1)
+		if err != nil {
+			return nil, err
+		}
+		return &model.Order{OrderInfo: *info, ID: fmt.Sprintf("order-%d", n), Status: model.CREATED}, nil
+	}}
+}
+
+func postOrder(orderController controller.OrderController, key string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(body))
+	if key != "" {
+		request.Header.Set(controller.IdempotencyKeyHeader, key)
+	}
+	orderController.CreateOrder(recorder, request)
+	return recorder
+}
+
+func TestCreateOrderReplaysIdempotentRequests(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil))
+
+	first := postOrder(orderController, "abc-123", validOrderJSON)
+	require.Equal(t, http.StatusCreated, first.Code)
+	require.Empty(t, first.Header().Get(controller.IdempotentReplayedHeader))
+
+	retry := postOrder(orderController, "abc-123", validOrderJSON)
+	require.Equal(t, http.StatusCreated, retry.Code)
+	require.Equal(t, "true", retry.Header().Get(controller.IdempotentReplayedHeader))
+	require.Equal(t, "application/json", retry.Header().Get("Content-Type"))
+	require.JSONEq(t, first.Body.String(), retry.Body.String())
+	require.Equal(t, int32(1), calls.Load())
+
+	// Other keys and requests without key are not affected.
+	require.Equal(t, http.StatusCreated, postOrder(orderController, "abc-456", validOrderJSON).Code)
+	require.Equal(t, http.StatusCreated, postOrder(orderController, "", validOrderJSON).Code)
+	require.Equal(t, http.StatusCreated, postOrder(orderController, "", validOrderJSON).Code)
+	require.Equal(t, int32(4), calls.Load())
+}
+
+func TestCreateOrderReplaysWithCorrelationIDOfRetry(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil))
+	handler := controller.LogRequests(slog.New(slog.NewTextHandler(io.Discard, nil)), orderController.CreateOrder)
+	post := func(correlationID string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(validOrderJSON))
+		request.Header.Set(controller.IdempotencyKeyHeader, "abc-123")
+		request.Header.Set(logging.CorrelationIDHeader, correlationID)
+		handler(recorder, request)
+		return recorder
+	}
+
+	require.Equal(t, "first-attempt", post("first-attempt").Header().Get(logging.CorrelationIDHeader))
+	retry := post("second-attempt")
+	require.Equal(t, "true", retry.Header().Get(controller.IdempotentReplayedHeader))
+	require.Equal(t, "second-attempt", retry.Header().Get(logging.CorrelationIDHeader))
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestCreateOrderRejectsReusedIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil))
+
+	require.Equal(t, http.StatusCreated, postOrder(orderController, "abc-123", validOrderJSON).Code)
+
+	otherOrder := strings.Replace(validOrderJSON, `"quantity":1`, `"quantity":2`, 1)
+	recorder := postOrder(orderController, "abc-123", otherOrder)
+	require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	require.Equal(t, controller.ProblemContentType, recorder.Header().Get("Content-Type"))
+	require.Contains(t, recorder.Body.String(), controller.IdempotencyKeyReusedProblem)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestCreateOrderIdempotencyKeyExpires(t *testing.T) {
+	var calls atomic.Int32
+	now := time.Now()
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil),
+		controller.WithIdempotencyTTL(time.Hour), controller.WithIdempotencyClock(func() time.Time { return now }))
+
+	require.Equal(t, http.StatusCreated, postOrder(orderController, "abc-123", validOrderJSON).Code)
+	now = now.Add(59 * time.Minute)
+	require.Equal(t, "true", postOrder(orderController, "abc-123", validOrderJSON).Header().Get(controller.IdempotentReplayedHeader))
+	require.Equal(t, int32(1), calls.Load())
+
+	// Once expired, the key can be used again, even for another request.
+	now = now.Add(2 * time.Minute)
+	otherOrder := strings.Replace(validOrderJSON, `"quantity":1`, `"quantity":2`, 1)
+	recorder := postOrder(orderController, "abc-123", otherOrder)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.Empty(t, recorder.Header().Get(controller.IdempotentReplayedHeader))
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestCreateOrderDoesNotStoreServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, errors.New("kafka: broker transport failure")))
+
+	for range 2 {
+		require.Equal(t, http.StatusInternalServerError, postOrder(orderController, "abc-123", validOrderJSON).Code)
+	}
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestCreateOrderStoresClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil))
+
+	for range 2 {
+		require.Equal(t, http.StatusBadRequest, postOrder(orderController, "abc-123", `{}`).Code)
+	}
+	require.Equal(t, "true", postOrder(orderController, "abc-123", `{}`).Header().Get(controller.IdempotentReplayedHeader))
+	require.Equal(t, int32(0), calls.Load())
+}
+
+func TestCreateOrderRejectsConcurrentIdempotentRequest(t *testing.T) {
+	placing := make(chan struct{})
+	release := make(chan struct{})
+	orderController := controller.NewOrderController(&stubOrderService{placeOrder: func(info *model.OrderInfo) (*model.Order, error) {
+		close(placing)
+		<-release
+		return &model.Order{OrderInfo: *info, ID: "order-1", Status: model.CREATED}, nil
+	}})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- postOrder(orderController, "abc-123", validOrderJSON)
+	}()
+	<-placing
+
+	recorder := postOrder(orderController, "abc-123", validOrderJSON)
+	require.Equal(t, http.StatusConflict, recorder.Code)
+	require.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	require.Contains(t, recorder.Body.String(), controller.RequestInProgressProblem)
+
+	close(release)
+	require.Equal(t, http.StatusCreated, (<-done).Code)
+	require.Equal(t, "true", postOrder(orderController, "abc-123", validOrderJSON).Header().Get(controller.IdempotentReplayedHeader))
+}
+
+func TestCreateOrderRejectsInvalidIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil))
+
+	recorder := postOrder(orderController, strings.Repeat("k", 256), validOrderJSON)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	require.Contains(t, recorder.Body.String(), `"field":"Idempotency-Key"`)
+	require.Equal(t, int32(0), calls.Load())
+}
+
+func TestCreateOrderScopesIdempotencyKeysToCustomers(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil))
+
+	require.Equal(t, http.StatusCreated, postOrder(orderController, "abc-123", validOrderJSON).Code)
+	otherCustomerOrder := strings.Replace(validOrderJSON, "lbroudoux", "yada", 1)
+	recorder := postOrder(orderController, "abc-123", otherCustomerOrder)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.Empty(t, recorder.Header().Get(controller.IdempotentReplayedHeader))
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestCreateOrderForgetsOldestIdempotencyKeys(t *testing.T) {
+	var calls atomic.Int32
+	orderController := controller.NewOrderController(countingOrderService(&calls, nil), controller.WithIdempotencyMaxKeys(2))
+
+	for _, key := range []string{"key-1", "key-2", "key-3"} {
+		require.Equal(t, http.StatusCreated, postOrder(orderController, key, validOrderJSON).Code)
+	}
+	require.Equal(t, "true", postOrder(orderController, "key-3", validOrderJSON).Header().Get(controller.IdempotentReplayedHeader))
+	require.Empty(t, postOrder(orderController, "key-1", validOrderJSON).Header().Get(controller.IdempotentReplayedHeader))
+	require.Equal(t, int32(4), calls.Load())
+}
+
+func TestCreateOrderRejectsIdempotentRequestsWhenKeysAreExhausted(t *testing.T) {
+	placing := make(chan struct{})
+	release := make(chan struct{})
+	orderController := controller.NewOrderController(&stubOrderService{placeOrder: func(info *model.OrderInfo) (*model.Order, error) {
+		close(placing)
+		<-release
+		return &model.Order{OrderInfo: *info, ID: "order-1", Status: model.CREATED}, nil
+	}}, controller.WithIdempotencyMaxKeys(1))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- postOrder(orderController, "key-1", validOrderJSON)
+	}()
+	<-placing
+
+	recorder := postOrder(orderController, "key-2", validOrderJSON)
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	require.Contains(t, recorder.Body.String(), controller.IdempotencyKeysExhaustedProblem)
+
+	close(release)
+	require.Equal(t, http.StatusCreated, (<-done).Code)
+}
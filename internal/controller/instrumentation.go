@@ -0,0 +1,114 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentHandler counts and times requests served by handler, labelled with route
+// rather than with their path so that order IDs do not end up in metrics.
+func InstrumentHandler(m *metrics.Metrics, route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		handler(sw, r)
+
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "OTHER"
+		}
+		code := strconv.Itoa(sw.status)
+		if sw.status == 0 {
+			code = strconv.Itoa(http.StatusOK)
+		}
+		m.HTTPRequests.WithLabelValues(route, method, code).Inc()
+		m.HTTPRequestDuration.WithLabelValues(route, method, code).Observe(time.Since(start).Seconds())
+	}
+}
+
+// LogRequests logs requests served by handler. Requests are identified like in problem
+// responses, and correlated by their X-Correlation-ID header or else by their ID. Both IDs are
+// attached to records logged with the request context, and the correlation ID is sent back.
+func LogRequests(logger *slog.Logger, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := traceID(r)
+		correlationID := r.Header.Get(logging.CorrelationIDHeader)
+		if correlationID == "" {
+			correlationID = requestID
+		}
+		ctx := logging.WithCorrelationID(logging.WithRequestID(r.Context(), requestID), correlationID)
+		w.Header().Set(logging.CorrelationIDHeader, correlationID)
+
+		sw := &statusWriter{ResponseWriter: w}
+		handler(sw, r.WithContext(ctx))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		logger.InfoContext(ctx, "Request served", "method", r.Method, "path", r.URL.Path,
+			"status", status, "duration", time.Since(start).Round(time.Microsecond).String())
+	}
+}
+
+// statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// endServerSpan records the status code of a response on span before ending it.
+func endServerSpan(span trace.Span, status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
@@ -0,0 +1,106 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/controller"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	orderController := controller.NewOrderController(&stubOrderService{
+		placeOrder: func(info *model.OrderInfo) (*model.Order, error) {
+			return &model.Order{OrderInfo: *info, ID: "order-1", Status: model.CREATED}, nil
+		},
+		getOrderHistory: func(id string) ([]model.OrderEvent, error) {
+			return nil, &service.OrderNotFoundError{ID: id}
+		},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/orders", controller.InstrumentHandler(m, "/api/orders", orderController.CreateOrder))
+	mux.HandleFunc("GET /api/orders/{id}/history", controller.InstrumentHandler(m, "/api/orders/{id}/history", orderController.GetOrderHistory))
+
+	for range 2 {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(validOrderJSON)))
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(`{}`)))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/orders/123/history", nil))
+
+	require.InDelta(t, 2, testutil.ToFloat64(m.HTTPRequests.WithLabelValues("/api/orders", "POST", "201")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(m.HTTPRequests.WithLabelValues("/api/orders", "POST", "400")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(m.HTTPRequests.WithLabelValues("/api/orders/{id}/history", "GET", "404")), 0)
+	require.Equal(t, 3, testutil.CollectAndCount(m.HTTPRequestDuration))
+}
+
+func TestLogRequests(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := logging.New(&buffer, logging.FormatJSON, slog.LevelInfo)
+	require.NoError(t, err)
+	orderController := controller.NewOrderController(&stubOrderService{
+		placeOrder: func(_ *model.OrderInfo) (*model.Order, error) {
+			return nil, errors.New("boom")
+		},
+	}, controller.WithLogger(logger))
+	handler := controller.LogRequests(logger, orderController.CreateOrder)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(validOrderJSON))
+	request.Header.Set("X-Request-ID", "request-1")
+	request.Header.Set(logging.CorrelationIDHeader, "correlation-1")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "correlation-1", recorder.Header().Get(logging.CorrelationIDHeader))
+	decoder := json.NewDecoder(&buffer)
+	for _, msg := range []string{"Failed to handle request", "Request served"} {
+		var record map[string]any
+		require.NoError(t, decoder.Decode(&record))
+		assert.Equal(t, msg, record["msg"])
+		assert.Equal(t, "request-1", record["request_id"])
+		assert.Equal(t, "correlation-1", record["correlation_id"])
+	}
+
+	// Without headers, requests are correlated by their generated ID, also sent in problems.
+	buffer.Reset()
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(validOrderJSON)))
+
+	var problem map[string]any
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+	requestID := problem["traceId"]
+	assert.NotEmpty(t, requestID)
+	assert.Equal(t, requestID, recorder.Header().Get(logging.CorrelationIDHeader))
+	var record map[string]any
+	require.NoError(t, json.NewDecoder(&buffer).Decode(&record))
+	assert.Equal(t, requestID, record["request_id"])
+	assert.Equal(t, requestID, record["correlation_id"])
+}
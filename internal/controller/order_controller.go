@@ -15,54 +15,151 @@
 package controller
 
 import (
+	"crypto/sha256"
 	"encoding/json"
-	"errors"
-	"io"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type OrderController interface {
 	CreateOrder(w http.ResponseWriter, r *http.Request)
+	// AmendOrder replaces products of the order identified by the id path value.
+	AmendOrder(w http.ResponseWriter, r *http.Request)
+	// GetOrderHistory lists the events applied to the order identified by the id path value.
+	GetOrderHistory(w http.ResponseWriter, r *http.Request)
 }
 
 type orderController struct {
-	service service.OrderService
+	service     service.OrderService
+	idempotency *idempotencyStore
+	logger      *slog.Logger
 }
 
 type unavailableProduct struct {
 	ProductName string `json:"productName"`
 	Details     string `json:"details"`
+	Reason      string `json:"reason,omitempty"`
 }
 
-func NewOrderController(service service.OrderService) OrderController {
-	return &orderController{
-		service: service,
+// OrderControllerOption allows customizing an OrderController built with NewOrderController.
+type OrderControllerOption func(*orderController)
+
+// WithLogger sets the logger reporting unexpected errors.
+func WithLogger(logger *slog.Logger) OrderControllerOption {
+	return func(oc *orderController) {
+		oc.logger = logger
+	}
+}
+
+// WithIdempotencyTTL sets how long responses are replayed for requests with an Idempotency-Key.
+func WithIdempotencyTTL(ttl time.Duration) OrderControllerOption {
+	return func(oc *orderController) {
+		oc.idempotency.ttl = ttl
+	}
+}
+
+// WithIdempotencyMaxKeys bounds the number of remembered idempotency keys, responses of the
+// oldest ones being forgotten first. Requests are rejected with a 503 status when all keys
+// belong to requests in progress.
+func WithIdempotencyMaxKeys(maxKeys int) OrderControllerOption {
+	return func(oc *orderController) {
+		if maxKeys > 0 {
+			oc.idempotency.maxKeys = maxKeys
+		}
 	}
 }
 
+// WithIdempotencyClock sets the clock used to expire idempotency keys. Mainly for tests.
+func WithIdempotencyClock(now func() time.Time) OrderControllerOption {
+	return func(oc *orderController) {
+		oc.idempotency.now = now
+	}
+}
+
+func NewOrderController(service service.OrderService, opts ...OrderControllerOption) OrderController {
+	oc := &orderController{
+		service:     service,
+		idempotency: newIdempotencyStore(),
+		logger:      slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(oc)
+	}
+	return oc
+}
+
+// CreateOrder places an order. Requests having an Idempotency-Key header are processed once:
+// retries get the first response back, unless it was a server error or the client went
+// away. Keys are scoped to the route and the customer of the order. The request starts a
+// trace, or continues the one of its traceparent header.
 func (oc *orderController) CreateOrder(w http.ResponseWriter, r *http.Request) {
-	// Read OrderInfo from body.
+	ctx, span := tracing.Tracer().Start(tracing.ExtractHTTP(r.Context(), r.Header), "OrderController.CreateOrder",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.request.method", r.Method), attribute.String("url.path", r.URL.Path)))
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() { endServerSpan(span, sw.status) }()
+	w, r = sw, r.WithContext(ctx)
+
 	defer r.Body.Close()
-	body, _ := io.ReadAll(r.Body)
+	body, err := readBody(w, r)
+	if err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		oc.createOrder(w, r, body)
+		return
+	}
+	if err := checkIdempotencyKey(key); err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
+	scopedKey := idempotencyKey{route: r.Method + " " + r.URL.Path, customer: customerID(body), key: key}
+	replay, err := oc.idempotency.begin(scopedKey, sha256.Sum256(body))
+	if err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
+	if replay != nil {
+		replay.write(w)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: w}
+	completed := false
+	defer func() {
+		if !completed {
+			oc.idempotency.abort(scopedKey)
+		}
+	}()
+	oc.createOrder(recorder, r, body)
+	if recorder.status < http.StatusInternalServerError && recorder.status != statusClientClosedRequest {
+		oc.idempotency.complete(scopedKey, recorder.response())
+		completed = true
+	}
+}
+
+func (oc *orderController) createOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	// Read and validate OrderInfo from body.
 	info := model.OrderInfo{}
-	_ = json.Unmarshal([]byte(string(body)), &info)
+	if err := decodeRequest(body, &info); err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
 
 	// Place a new order.
-	order, err := oc.service.PlaceOrder(&info)
+	order, err := oc.service.PlaceOrder(r.Context(), &info)
 	if err != nil {
-		// Manage unavailable product.
-		var unavailableErr *service.UnavailablePastryError
-		if errors.As(err, &unavailableErr) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnprocessableEntity)
-			_ = json.NewEncoder(w).Encode(&unavailableProduct{
-				ProductName: unavailableErr.Error(),
-				Details:     "Pastry " + unavailableErr.Error() + " is not available",
-			})
-		}
+		oc.writeError(w, r, err)
 		return
 	}
 
@@ -71,3 +168,55 @@ func (oc *orderController) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(order)
 }
+
+func (oc *orderController) AmendOrder(w http.ResponseWriter, r *http.Request) {
+	// Read and validate OrderAmendment from body.
+	defer r.Body.Close()
+	body, err := readBody(w, r)
+	if err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
+	amendment := model.OrderAmendment{}
+	if err := decodeRequest(body, &amendment); err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
+
+	// Amend the order.
+	order, err := oc.service.AmendOrder(r.Context(), r.PathValue("id"), &amendment)
+	if err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
+
+	// Serialize order to JSON and write response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(order)
+}
+
+func (oc *orderController) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := oc.service.GetOrderHistory(r.PathValue("id"))
+	if err != nil {
+		oc.writeError(w, r, err)
+		return
+	}
+
+	// Serialize events to JSON and write response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(history)
+}
+
+func newUnavailableProduct(pastry service.UnavailablePastry) unavailableProduct {
+	details := "Pastry " + pastry.Product + " is not available"
+	if pastry.Reason == service.UnknownPastry {
+		details = "Pastry " + pastry.Product + " is unknown"
+	}
+	return unavailableProduct{
+		ProductName: pastry.Product,
+		Details:     details,
+		Reason:      string(pastry.Reason),
+	}
+}
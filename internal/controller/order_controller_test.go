@@ -0,0 +1,384 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/controller"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/stretchr/testify/require"
+)
+
+const validOrderJSON = `{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1}],"totalPrice":4.4}`
+
+// stubOrderService is an OrderService whose outcomes are decided by the test.
+type stubOrderService struct {
+	placeOrder      func(info *model.OrderInfo) (*model.Order, error)
+	amendOrder      func(id string, amendment *model.OrderAmendment) (*model.Order, error)
+	getOrderHistory func(id string) ([]model.OrderEvent, error)
+}
+
+func (s *stubOrderService) PlaceOrder(_ context.Context, info *model.OrderInfo) (*model.Order, error) {
+	return s.placeOrder(info)
+}
+
+func (s *stubOrderService) AmendOrder(_ context.Context, id string, amendment *model.OrderAmendment) (*model.Order, error) {
+	return s.amendOrder(id, amendment)
+}
+
+func (s *stubOrderService) GetOrder(_ string) *model.Order {
+	return nil
+}
+
+func (s *stubOrderService) GetOrderHistory(id string) ([]model.OrderEvent, error) {
+	return s.getOrderHistory(id)
+}
+
+func (s *stubOrderService) UpdateReviewedOrder(event *model.OrderEvent) *model.Order {
+	return &event.Order
+}
+
+func (s *stubOrderService) ReplayOrderEvent(_ *model.OrderEvent) {}
+
+func (s *stubOrderService) ExpireUnreviewedOrders(_ time.Time, _ time.Duration) []*model.Order {
+	return nil
+}
+
+func createOrder(t *testing.T, placeOrder func(info *model.OrderInfo) (*model.Order, error), body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	orderController := controller.NewOrderController(&stubOrderService{placeOrder: placeOrder})
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(body))
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	orderController.CreateOrder(recorder, request)
+	return recorder
+}
+
+func TestCreateOrderPastryAPIUnavailable(t *testing.T) {
+	recorder := createOrder(t, func(_ *model.OrderInfo) (*model.Order, error) {
+		return nil, fmt.Errorf("failed to check availability of Millefeuille: %w",
+			&client.UnavailableError{RetryAfter: 1500 * time.Millisecond, Err: client.ErrCircuitOpen})
+	}, validOrderJSON)
+
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.Equal(t, "2", recorder.Header().Get("Retry-After"))
+}
+
+func TestCreateOrderPastryAPIBadResponse(t *testing.T) {
+	recorder := createOrder(t, func(_ *model.OrderInfo) (*model.Order, error) {
+		return nil, fmt.Errorf("failed to check availability of Millefeuille: %w",
+			&client.DecodeError{Err: io.ErrUnexpectedEOF})
+	}, validOrderJSON)
+
+	require.Equal(t, http.StatusBadGateway, recorder.Code)
+	require.NotEmpty(t, recorder.Header().Get("Retry-After"))
+}
+
+func TestCreateOrderUnavailableProducts(t *testing.T) {
+	recorder := createOrder(t, func(_ *model.OrderInfo) (*model.Order, error) {
+		return nil, &service.UnavailablePastryError{Pastries: []service.UnavailablePastry{
+			{Product: "Eclair Chocolat", Reason: service.UnknownPastry},
+			{Product: "Baba Rhum", Reason: service.OutOfStockPastry},
+		}}
+	}, validOrderJSON)
+
+	require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	require.Equal(t, controller.ProblemContentType, recorder.Header().Get("Content-Type"))
+	require.JSONEq(t, `{
+		"type": "/problems/unavailable-pastry",
+		"title": "Unavailable pastries",
+		"status": 422,
+		"detail": "Pastry Eclair Chocolat is unknown",
+		"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"productName": "Eclair Chocolat",
+		"details": "Pastry Eclair Chocolat is unknown",
+		"reason": "unknown",
+		"unavailableProducts": [
+			{"productName": "Eclair Chocolat", "details": "Pastry Eclair Chocolat is unknown", "reason": "unknown"},
+			{"productName": "Baba Rhum", "details": "Pastry Baba Rhum is not available", "reason": "out_of_stock"}
+		]
+	}`, recorder.Body.String())
+}
+
+func TestCreateOrderTotalPriceMismatch(t *testing.T) {
+	recorder := createOrder(t, func(_ *model.OrderInfo) (*model.Order, error) {
+		return nil, &service.TotalPriceMismatchError{Expected: model.NewMoney(940, model.USD), Submitted: model.NewMoney(440, model.USD)}
+	}, validOrderJSON)
+
+	require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	require.JSONEq(t, `{
+		"type": "/problems/total-price-mismatch",
+		"title": "Wrong total price",
+		"status": 422,
+		"detail": "Total price should be 9.40",
+		"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"expectedTotalPrice": 9.4,
+		"submittedTotalPrice": 4.4
+	}`, recorder.Body.String())
+}
+
+func TestCreateOrderUnexpectedError(t *testing.T) {
+	recorder := createOrder(t, func(_ *model.OrderInfo) (*model.Order, error) {
+		return nil, errors.New("kafka: broker transport failure")
+	}, validOrderJSON)
+
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+	require.Equal(t, controller.ProblemContentType, recorder.Header().Get("Content-Type"))
+	require.JSONEq(t, `{
+		"type": "/problems/internal-error",
+		"title": "Internal error",
+		"status": 500,
+		"detail": "Request could not be processed, please retry later",
+		"traceId": "4bf92f3577b34da6a3ce929d0e0e4736"
+	}`, recorder.Body.String())
+}
+
+func TestCreateOrderCanceledByClient(t *testing.T) {
+	var logs bytes.Buffer
+	calls := 0
+	orderController := controller.NewOrderController(&stubOrderService{placeOrder: func(_ *model.OrderInfo) (*model.Order, error) {
+		calls++
+		return nil, fmt.Errorf("failed to check availability: %w", context.Canceled)
+	}}, controller.WithLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	for range 2 {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(validOrderJSON)).WithContext(ctx)
+		request.Header.Set(controller.IdempotencyKeyHeader, "abc-123")
+		orderController.CreateOrder(recorder, request)
+
+		// Nobody reads the response, which is not a server error.
+		require.Equal(t, 499, recorder.Code)
+		require.Empty(t, recorder.Body.String())
+	}
+	// Retries are processed again.
+	require.Equal(t, 2, calls)
+	require.Contains(t, logs.String(), "level=DEBUG msg=\"Client closed request\"")
+	require.NotContains(t, logs.String(), "level=ERROR")
+}
+
+func TestCreateOrderGeneratesTraceID(t *testing.T) {
+	orderController := controller.NewOrderController(&stubOrderService{})
+	traceIDs := make(map[string]bool)
+	for range 2 {
+		recorder := httptest.NewRecorder()
+		orderController.CreateOrder(recorder, httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(`{}`)))
+
+		var problem map[string]any
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+		require.Regexp(t, "^[0-9a-f]{32}$", problem["traceId"])
+		traceIDs[problem["traceId"].(string)] = true
+	}
+	require.Len(t, traceIDs, 2)
+}
+
+func TestCreateOrderRejectsInvalidRequests(t *testing.T) {
+	for name, test := range map[string]struct {
+		body     string
+		expected string
+	}{
+		"malformed JSON": {
+			body:     `{"customerId":"lbroudoux",`,
+			expected: `[{"message": "body must be a valid JSON object"}]`,
+		},
+		"empty body": {
+			body:     ``,
+			expected: `[{"message": "body must be a valid JSON object"}]`,
+		},
+		"several objects": {
+			body:     validOrderJSON + validOrderJSON,
+			expected: `[{"message": "body must contain a single JSON object"}]`,
+		},
+		"unknown field": {
+			body:     `{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1}],"totalPrice":4.4,"discount":1}`,
+			expected: `[{"field": "discount", "message": "is not allowed"}]`,
+		},
+		"wrong types": {
+			body:     `{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1},{"productName":"Eclair Cafe","quantity":"one"}],"totalPrice":4.4}`,
+			expected: `[{"field": "productQuantities[1].quantity", "message": "must be an integer"}]`,
+		},
+		"wrong price type": {
+			body:     `{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":1}],"totalPrice":"4.4"}`,
+			expected: `[{"message": "a value must be a number"}]`,
+		},
+		"missing fields": {
+			body: `{"productQuantities":[]}`,
+			expected: `[
+				{"field": "customerId", "message": "is required"},
+				{"field": "productQuantities", "message": "must contain at least one product"},
+				{"field": "totalPrice", "message": "must be positive"}
+			]`,
+		},
+		"invalid products": {
+			body: `{"customerId":"lbroudoux","productQuantities":[{"productName":"Millefeuille","quantity":-1},{"quantity":2}],"totalPrice":4.4}`,
+			expected: `[
+				{"field": "productQuantities[0].quantity", "message": "must be positive"},
+				{"field": "productQuantities[1].productName", "message": "is required"}
+			]`,
+		},
+		"too large": {
+			body:     `{"customerId":"` + strings.Repeat("x", 64<<10) + `"}`,
+			expected: `[{"message": "body must not exceed 65536 bytes"}]`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder := createOrder(t, func(_ *model.OrderInfo) (*model.Order, error) {
+				t.Fatal("invalid order must not be placed")
+				return nil, nil
+			}, test.body)
+
+			require.Equal(t, http.StatusBadRequest, recorder.Code)
+			require.Equal(t, controller.ProblemContentType, recorder.Header().Get("Content-Type"))
+			require.JSONEq(t, `{
+				"type": "/problems/invalid-request",
+				"title": "Invalid request",
+				"status": 400,
+				"detail": "Request is invalid",
+				"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"fieldErrors": `+test.expected+`
+			}`, recorder.Body.String())
+		})
+	}
+}
+
+func TestCreateOrderPlacesValidRequest(t *testing.T) {
+	recorder := createOrder(t, func(info *model.OrderInfo) (*model.Order, error) {
+		require.Equal(t, model.NewMoney(440, model.USD), info.TotalPrice)
+		return &model.Order{OrderInfo: *info, ID: "123", Status: model.CREATED}, nil
+	}, validOrderJSON)
+
+	require.Equal(t, http.StatusCreated, recorder.Code)
+}
+
+func amendOrder(t *testing.T, amend func(id string, amendment *model.OrderAmendment) (*model.Order, error), id string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	orderController := controller.NewOrderController(&stubOrderService{amendOrder: amend})
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPut, "/api/orders/"+id, strings.NewReader(body))
+	request.SetPathValue("id", id)
+	orderController.AmendOrder(recorder, request)
+	return recorder
+}
+
+func TestAmendOrder(t *testing.T) {
+	recorder := amendOrder(t, func(id string, amendment *model.OrderAmendment) (*model.Order, error) {
+		require.Equal(t, "123", id)
+		require.Equal(t, []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}}, amendment.ProductQuantities)
+		return &model.Order{
+			OrderInfo: model.OrderInfo{CustomerID: "lbroudoux", ProductQuantities: amendment.ProductQuantities, TotalPrice: amendment.TotalPrice},
+			ID:        id,
+			Status:    model.CREATED,
+		}, nil
+	}, "123", `{"productQuantities":[{"productName":"Eclair Cafe","quantity":2}],"totalPrice":5}`)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{
+		"id": "123",
+		"status": "CREATED",
+		"customerId": "lbroudoux",
+		"productQuantities": [{"productName": "Eclair Cafe", "quantity": 2}],
+		"totalPrice": 5
+	}`, recorder.Body.String())
+}
+
+func TestAmendOrderErrors(t *testing.T) {
+	const amendment = `{"productQuantities":[{"productName":"Eclair Cafe","quantity":2}],"totalPrice":5}`
+	for name, test := range map[string]struct {
+		err         error
+		body        string
+		status      int
+		problemType string
+	}{
+		"unknown order":   {err: &service.OrderNotFoundError{ID: "123"}, body: amendment, status: http.StatusNotFound, problemType: controller.OrderNotFoundProblem},
+		"reviewed order":  {err: &service.OrderNotAmendableError{ID: "123", Status: model.VALIDATED}, body: amendment, status: http.StatusConflict, problemType: controller.OrderNotAmendableProblem},
+		"customer change": {body: `{"customerId":"jdoe","productQuantities":[{"productName":"Eclair Cafe","quantity":2}],"totalPrice":5}`, status: http.StatusBadRequest, problemType: controller.InvalidRequestProblem},
+		"no product":      {body: `{"productQuantities":[],"totalPrice":5}`, status: http.StatusBadRequest, problemType: controller.InvalidRequestProblem},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder := amendOrder(t, func(_ string, _ *model.OrderAmendment) (*model.Order, error) {
+				require.NotNil(t, test.err, "invalid amendment must not be applied")
+				return nil, test.err
+			}, "123", test.body)
+
+			require.Equal(t, test.status, recorder.Code)
+			require.Equal(t, controller.ProblemContentType, recorder.Header().Get("Content-Type"))
+			var problem map[string]any
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+			require.Equal(t, test.problemType, problem["type"])
+		})
+	}
+}
+
+func TestGetOrderHistory(t *testing.T) {
+	orderController := controller.NewOrderController(&stubOrderService{getOrderHistory: func(id string) ([]model.OrderEvent, error) {
+		if id != "123" {
+			return nil, &service.OrderNotFoundError{ID: id}
+		}
+		order := model.Order{
+			OrderInfo: model.OrderInfo{
+				CustomerID:        "lbroudoux",
+				ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}},
+				TotalPrice:        model.NewMoney(500, model.USD),
+			},
+			ID:     id,
+			Status: model.CREATED,
+		}
+		validated := order
+		validated.Status = model.VALIDATED
+		return []model.OrderEvent{
+			{Timestamp: 1706087114133, Order: order, ChangeReason: "Creation"},
+			{Timestamp: 1706087118451, Order: validated, ChangeReason: "Validation"},
+		}, nil
+	}})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/orders/123/history", nil)
+	request.SetPathValue("id", "123")
+	orderController.GetOrderHistory(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var history []map[string]any
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &history))
+	require.Len(t, history, 2)
+	require.Equal(t, "Creation", history[0]["changeReason"])
+	require.Equal(t, "Validation", history[1]["changeReason"])
+	require.Equal(t, "VALIDATED", history[1]["order"].(map[string]any)["status"])
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, "/api/orders/456/history", nil)
+	request.SetPathValue("id", "456")
+	orderController.GetOrderHistory(recorder, request)
+
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+	require.Contains(t, recorder.Body.String(), controller.OrderNotFoundProblem)
+}
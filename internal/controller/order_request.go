@@ -0,0 +1,208 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+)
+
+// maxOrderInfoSize is the maximum size in bytes of an order request body.
+const maxOrderInfoSize = 64 << 10
+
+// readBody reads request body, up to maxOrderInfoSize bytes. An invalidRequestError is
+// returned if body is too large or cannot be read.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOrderInfoSize))
+	if err != nil {
+		return nil, &invalidRequestError{fieldErrors: []model.FieldError{decodingError(body, err)}}
+	}
+	return body, nil
+}
+
+// validatable is a request that can tell its invalid fields.
+type validatable interface {
+	Validate() []model.FieldError
+}
+
+// decodeRequest strictly reads request from body and validates it. An
+// invalidRequestError is returned if body is not a valid request.
+func decodeRequest(body []byte, request validatable) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(request); err != nil {
+		return &invalidRequestError{fieldErrors: []model.FieldError{decodingError(body, err)}}
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return &invalidRequestError{fieldErrors: []model.FieldError{{Message: "body must contain a single JSON object"}}}
+	}
+	if fieldErrors := request.Validate(); len(fieldErrors) > 0 {
+		return &invalidRequestError{fieldErrors: fieldErrors}
+	}
+	return nil
+}
+
+// checkIdempotencyKey validates an Idempotency-Key header value.
+func checkIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength || strings.IndexFunc(key, func(c rune) bool { return c < ' ' || c > '~' }) >= 0 {
+		return &invalidRequestError{fieldErrors: []model.FieldError{{
+			Field:   IdempotencyKeyHeader,
+			Message: fmt.Sprintf("must be at most %d printable ASCII characters", maxIdempotencyKeyLength),
+		}}}
+	}
+	return nil
+}
+
+// customerID reads the customer of an order request body, or returns an empty string if
+// body is not a JSON object with a customerId string member.
+func customerID(body []byte) string {
+	var customer struct {
+		CustomerID string `json:"customerId"`
+	}
+	_ = json.Unmarshal(body, &customer)
+	return customer.CustomerID
+}
+
+// decodingError explains why body cannot be read as JSON.
+func decodingError(body []byte, err error) model.FieldError {
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return model.FieldError{Message: fmt.Sprintf("body must not exceed %d bytes", maxBytesErr.Limit)}
+	case errors.As(err, &typeErr) && typeErr.Offset > 0:
+		return model.FieldError{Field: fieldPath(body, typeErr.Offset), Message: "must be " + jsonType(typeErr.Type)}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return model.FieldError{Field: typeErr.Field, Message: "must be " + jsonType(typeErr.Type)}
+	case errors.As(err, &typeErr):
+		// Field may be unknown when the error comes from a json.Unmarshaler.
+		return model.FieldError{Message: "a value must be " + jsonType(typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no dedicated error type for unknown fields.
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return model.FieldError{Field: field, Message: "is not allowed"}
+	default:
+		return model.FieldError{Message: "body must be a valid JSON object"}
+	}
+}
+
+// jsonLevel is an object or array being read by fieldPath, with the member or element
+// currently read.
+type jsonLevel struct {
+	array bool
+	key   string
+	index int
+	// expectKey tells if the next token of an object is a member name.
+	expectKey bool
+}
+
+// fieldPath finds the path in FieldError format (ex: productQuantities[0].quantity) of
+// the JSON value of body read at offset. Type errors of encoding/json give the path of
+// the Go field, without array indices.
+func fieldPath(body []byte, offset int64) string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var levels []jsonLevel
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		delim, isDelim := token.(json.Delim)
+		if len(levels) > 0 && levels[len(levels)-1].expectKey {
+			if isDelim {
+				levels = endValue(levels[:len(levels)-1])
+				continue
+			}
+			levels[len(levels)-1].key, _ = token.(string)
+			levels[len(levels)-1].expectKey = false
+			continue
+		}
+		if delim == ']' {
+			levels = endValue(levels[:len(levels)-1])
+			continue
+		}
+
+		// token starts a value.
+		if decoder.InputOffset() >= offset {
+			return formatPath(levels)
+		}
+		switch delim {
+		case '{':
+			levels = append(levels, jsonLevel{expectKey: true})
+		case '[':
+			levels = append(levels, jsonLevel{array: true})
+		default:
+			levels = endValue(levels)
+		}
+	}
+}
+
+// endValue moves the innermost level of levels past the value just read.
+func endValue(levels []jsonLevel) []jsonLevel {
+	if len(levels) > 0 {
+		if top := &levels[len(levels)-1]; top.array {
+			top.index++
+		} else {
+			top.expectKey = true
+		}
+	}
+	return levels
+}
+
+// formatPath writes the path of the values currently read in levels.
+func formatPath(levels []jsonLevel) string {
+	var path strings.Builder
+	for i, level := range levels {
+		switch {
+		case level.array:
+			path.WriteString("[" + strconv.Itoa(level.index) + "]")
+		case i > 0:
+			path.WriteString("." + level.key)
+		default:
+			path.WriteString(level.key)
+		}
+	}
+	return path.String()
+}
+
+// jsonType names the JSON type expected for Go type t.
+func jsonType(t reflect.Type) string {
+	switch {
+	case t == reflect.TypeOf(model.Money{}):
+		return "a number"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return "an integer"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return "a number"
+	case t.Kind() == reflect.String:
+		return "a string"
+	case t.Kind() == reflect.Bool:
+		return "a boolean"
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/controller"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	createdTopic  = "orders-created"
+	reviewedTopic = "orders-reviewed"
+)
+
+// recordSpans makes an in-memory exporter receive the spans of the global tracer provider
+// until the end of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	tracing.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// findSpan returns the span named name, failing the test if there is not exactly one.
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	var found []tracetest.SpanStub
+	for _, span := range spans {
+		if span.Name == name {
+			found = append(found, span)
+		}
+	}
+	require.Len(t, found, 1, "spans named %s", name)
+	return found[0]
+}
+
+func TestOrderTraceSpansPastryAPIAndKafka(t *testing.T) {
+	exporter := recordSpans(t)
+
+	// Kafka is an in-process mock cluster.
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	defer cluster.Close()
+	require.NoError(t, cluster.CreateTopic(createdTopic, 1, 1))
+	require.NoError(t, cluster.CreateTopic(reviewedTopic, 1, 1))
+
+	var mu sync.Mutex
+	var traceparents []string
+	pastryAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"Millefeuille","description":"Delicieux Millefeuille pas calorique du tout","size":"L","price":4.4,"status":"available"}`))
+	}))
+	defer pastryAPI.Close()
+
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": cluster.BootstrapServers()})
+	require.NoError(t, err)
+	defer producer.Close()
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cluster.BootstrapServers(),
+		"group.id":          "order-service",
+		"auto.offset.reset": "earliest",
+	})
+	require.NoError(t, err)
+	defer consumer.Close()
+
+	orderService := service.NewOrderService(client.NewPastryAPIClient(pastryAPI.URL),
+		service.NewOrderEventPublisher(producer, createdTopic))
+	listener := service.NewOrderEventListener(consumer, reviewedTopic, orderService,
+		service.WithListenerConfig(service.OrderEventListenerConfig{MaxRetries: 1, RetryBackoff: 10 * time.Millisecond, MessageTimeout: 100 * time.Millisecond}))
+	_, err = listener.Listen(context.Background())
+	require.NoError(t, err)
+	defer listener.Stop()
+
+	// Place an order.
+	request := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(validOrderJSON))
+	recorder := httptest.NewRecorder()
+	controller.NewOrderController(orderService).CreateOrder(recorder, request)
+	require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+
+	// Review it like a reviewer propagating the trace context it received.
+	reviewer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cluster.BootstrapServers(),
+		"group.id":          "reviewer",
+		"auto.offset.reset": "earliest",
+	})
+	require.NoError(t, err)
+	defer reviewer.Close()
+	require.NoError(t, reviewer.Subscribe(createdTopic, nil))
+	created, err := reviewer.ReadMessage(10 * time.Second)
+	require.NoError(t, err)
+
+	var event model.OrderEvent
+	require.NoError(t, json.Unmarshal(created.Value, &event))
+	event.Order.Status = model.VALIDATED
+	event.ChangeReason = "Review"
+	reviewJSON, err := json.Marshal(event)
+	require.NoError(t, err)
+	topic := reviewedTopic
+	require.NoError(t, producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          reviewJSON,
+		Headers:        created.Headers,
+	}, nil))
+	producer.Flush(1000)
+
+	require.Eventually(t, func() bool {
+		for _, span := range exporter.GetSpans() {
+			if span.Name == "OrderEventListener.processMessage" {
+				return true
+			}
+		}
+		return false
+	}, 15*time.Second, 50*time.Millisecond)
+	assert.Equal(t, model.VALIDATED, orderService.GetOrder(event.Order.ID).Status)
+
+	// CreateOrder > PastryAPI.GetPastry & OrderEventPublisher.PublishOrderEvent > OrderEventListener.processMessage
+	spans := exporter.GetSpans()
+	createOrder := findSpan(t, spans, "OrderController.CreateOrder")
+	getPastry := findSpan(t, spans, "PastryAPI.GetPastry")
+	publish := findSpan(t, spans, "OrderEventPublisher.PublishOrderEvent")
+	process := findSpan(t, spans, "OrderEventListener.processMessage")
+
+	assert.False(t, createOrder.Parent.IsValid())
+	assert.Equal(t, trace.SpanKindServer, createOrder.SpanKind)
+	traceID := createOrder.SpanContext.TraceID()
+	for _, span := range []tracetest.SpanStub{getPastry, publish, process} {
+		assert.Equal(t, traceID, span.SpanContext.TraceID(), span.Name)
+	}
+	assert.Equal(t, createOrder.SpanContext.SpanID(), getPastry.Parent.SpanID())
+	assert.Equal(t, trace.SpanKindClient, getPastry.SpanKind)
+	assert.Equal(t, createOrder.SpanContext.SpanID(), publish.Parent.SpanID())
+	assert.Equal(t, trace.SpanKindProducer, publish.SpanKind)
+	assert.Equal(t, publish.SpanContext.SpanID(), process.Parent.SpanID())
+	assert.True(t, process.Parent.IsRemote())
+	assert.Equal(t, trace.SpanKindConsumer, process.SpanKind)
+
+	// The Pastry API is called within the GetPastry span.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"00-" + traceID.String() + "-" + getPastry.SpanContext.SpanID().String() + "-01"}, traceparents)
+}
+
+func TestCreateOrderContinuesIncomingTrace(t *testing.T) {
+	exporter := recordSpans(t)
+	orderController := controller.NewOrderController(&stubOrderService{
+		placeOrder: func(_ *model.OrderInfo) (*model.Order, error) {
+			return nil, &service.UnavailablePastryError{
+				Pastries: []service.UnavailablePastry{{Product: "Millefeuille", Reason: service.OutOfStockPastry}},
+			}
+		},
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(validOrderJSON))
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+	orderController.CreateOrder(recorder, request)
+
+	spans := exporter.GetSpans()
+	createOrder := findSpan(t, spans, "OrderController.CreateOrder")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", createOrder.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", createOrder.Parent.SpanID().String())
+	var problem map[string]any
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", problem["traceId"])
+}
@@ -0,0 +1,296 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem details.
+const ProblemContentType = "application/problem+json"
+
+// Problem types, relative to the API base URL.
+const (
+	InvalidRequestProblem           = "/problems/invalid-request"
+	UnavailablePastryProblem        = "/problems/unavailable-pastry"
+	TotalPriceMismatchProblem       = "/problems/total-price-mismatch"
+	PastryAPIUnavailableProblem     = "/problems/pastry-api-unavailable"
+	PastryAPIBadResponseProblem     = "/problems/pastry-api-bad-response"
+	OrderNotFoundProblem            = "/problems/order-not-found"
+	OrderNotAmendableProblem        = "/problems/order-not-amendable"
+	IdempotencyKeyReusedProblem     = "/problems/idempotency-key-reused"
+	RequestInProgressProblem        = "/problems/request-in-progress"
+	IdempotencyKeysExhaustedProblem = "/problems/idempotency-keys-exhausted"
+	InternalErrorProblem            = "/problems/internal-error"
+	ApplicationStartingProblem      = "/problems/application-starting"
+)
+
+// defaultRetryAfter is the delay suggested to clients when the upstream gave no hint.
+const defaultRetryAfter = 5 * time.Second
+
+// statusClientClosedRequest is the non-standard status, borrowed from nginx, of requests
+// whose client went away before being answered.
+const statusClientClosedRequest = 499
+
+// problem holds RFC 7807 problem details. Extensions are the members specific to the
+// problem type, written along the standard ones.
+type problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	TraceID    string
+	Extensions map[string]any
+
+	// retryAfter is sent as Retry-After header when set.
+	retryAfter time.Duration
+}
+
+func (p *problem) MarshalJSON() ([]byte, error) {
+	members := make(map[string]any, len(p.Extensions)+5)
+	maps.Copy(members, p.Extensions)
+	members["type"] = p.Type
+	members["title"] = p.Title
+	members["status"] = p.Status
+	members["traceId"] = p.TraceID
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	return json.Marshal(members)
+}
+
+// invalidRequestError is raised by handlers when a request cannot be read.
+type invalidRequestError struct {
+	fieldErrors []model.FieldError
+}
+
+func (e *invalidRequestError) Error() string {
+	messages := make([]string, len(e.fieldErrors))
+	for i, fieldError := range e.fieldErrors {
+		messages[i] = strings.TrimSpace(fieldError.Field + " " + fieldError.Message)
+	}
+	return "invalid request: " + strings.Join(messages, ", ")
+}
+
+// writeError renders err as a problem+json response. Unexpected errors are logged with
+// the trace ID of the request and not disclosed to clients. Requests canceled by their
+// client get a bare statusClientClosedRequest, as nobody reads it.
+func (oc *orderController) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		oc.logger.DebugContext(r.Context(), "Client closed request", "method", r.Method, "path", r.URL.Path, "error", err)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	p := newProblem(err)
+	p.TraceID = traceID(r)
+	if p.Status == http.StatusInternalServerError {
+		oc.logger.ErrorContext(r.Context(), "Failed to handle request", "method", r.Method, "path", r.URL.Path, "traceId", p.TraceID, "error", err)
+	}
+	writeProblem(w, p)
+}
+
+// RequireReady answers 503 to requests received while ready returns false, such as while
+// orders are rebuilt at startup.
+func RequireReady(ready func() bool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ready() {
+			handler(w, r)
+			return
+		}
+		writeProblem(w, &problem{
+			Type:       ApplicationStartingProblem,
+			Title:      "Application starting",
+			Status:     http.StatusServiceUnavailable,
+			Detail:     "Orders are being rebuilt, please retry later",
+			TraceID:    traceID(r),
+			retryAfter: defaultRetryAfter,
+		})
+	}
+}
+
+// writeProblem renders p as a problem+json response.
+func writeProblem(w http.ResponseWriter, p *problem) {
+	if p.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(p.retryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// newProblem maps a domain error to the problem describing it.
+func newProblem(err error) *problem {
+	var invalidErr *invalidRequestError
+	if errors.As(err, &invalidErr) {
+		return &problem{
+			Type:       InvalidRequestProblem,
+			Title:      "Invalid request",
+			Status:     http.StatusBadRequest,
+			Detail:     "Request is invalid",
+			Extensions: map[string]any{"fieldErrors": invalidErr.fieldErrors},
+		}
+	}
+
+	var reusedErr *idempotencyKeyReusedError
+	if errors.As(err, &reusedErr) {
+		return &problem{
+			Type:   IdempotencyKeyReusedProblem,
+			Title:  "Idempotency key reused",
+			Status: http.StatusUnprocessableEntity,
+			Detail: "Idempotency-Key " + reusedErr.key + " was already used for a different request",
+		}
+	}
+	var inProgressErr *idempotencyKeyInProgressError
+	if errors.As(err, &inProgressErr) {
+		return &problem{
+			Type:       RequestInProgressProblem,
+			Title:      "Request in progress",
+			Status:     http.StatusConflict,
+			Detail:     "Request with Idempotency-Key " + inProgressErr.key + " is still in progress",
+			retryAfter: time.Second,
+		}
+	}
+	var exhaustedErr *idempotencyKeysExhaustedError
+	if errors.As(err, &exhaustedErr) {
+		return &problem{
+			Type:       IdempotencyKeysExhaustedProblem,
+			Title:      "Too many requests in progress",
+			Status:     http.StatusServiceUnavailable,
+			Detail:     "Too many requests with an Idempotency-Key are in progress, please retry later",
+			retryAfter: time.Second,
+		}
+	}
+
+	var notFoundErr *service.OrderNotFoundError
+	if errors.As(err, &notFoundErr) {
+		return &problem{
+			Type:   OrderNotFoundProblem,
+			Title:  "Order not found",
+			Status: http.StatusNotFound,
+			Detail: "Order " + notFoundErr.ID + " does not exist",
+		}
+	}
+	var notAmendableErr *service.OrderNotAmendableError
+	if errors.As(err, &notAmendableErr) {
+		return &problem{
+			Type:       OrderNotAmendableProblem,
+			Title:      "Order not amendable",
+			Status:     http.StatusConflict,
+			Detail:     "Order " + notAmendableErr.ID + " has been reviewed and cannot be amended anymore",
+			Extensions: map[string]any{"orderStatus": notAmendableErr.Status},
+		}
+	}
+
+	var unavailableErr *service.UnavailablePastryError
+	if errors.As(err, &unavailableErr) && len(unavailableErr.Pastries) > 0 {
+		products := make([]unavailableProduct, len(unavailableErr.Pastries))
+		for i, pastry := range unavailableErr.Pastries {
+			products[i] = newUnavailableProduct(pastry)
+		}
+		// Keep the first unavailable product at top level, details included, for clients only
+		// expecting a single one.
+		return &problem{
+			Type:   UnavailablePastryProblem,
+			Title:  "Unavailable pastries",
+			Status: http.StatusUnprocessableEntity,
+			Detail: products[0].Details,
+			Extensions: map[string]any{
+				"productName":         products[0].ProductName,
+				"details":             products[0].Details,
+				"reason":              products[0].Reason,
+				"unavailableProducts": products,
+			},
+		}
+	}
+
+	var mismatchErr *service.TotalPriceMismatchError
+	if errors.As(err, &mismatchErr) {
+		return &problem{
+			Type:   TotalPriceMismatchProblem,
+			Title:  "Wrong total price",
+			Status: http.StatusUnprocessableEntity,
+			Detail: "Total price should be " + mismatchErr.Expected.Decimal(),
+			Extensions: map[string]any{
+				"expectedTotalPrice":  mismatchErr.Expected,
+				"submittedTotalPrice": mismatchErr.Submitted,
+			},
+		}
+	}
+
+	// Pastry API outages are temporary, other failures are bad answers.
+	var outageErr *client.UnavailableError
+	if errors.As(err, &outageErr) {
+		return &problem{
+			Type:       PastryAPIUnavailableProblem,
+			Title:      "Pastry API unavailable",
+			Status:     http.StatusServiceUnavailable,
+			Detail:     "Pastry API is unavailable, please retry later",
+			retryAfter: cmp.Or(outageErr.RetryAfter, defaultRetryAfter),
+		}
+	}
+	var decodeErr *client.DecodeError
+	var statusErr *client.StatusError
+	if errors.As(err, &decodeErr) || errors.As(err, &statusErr) {
+		return &problem{
+			Type:       PastryAPIBadResponseProblem,
+			Title:      "Pastry API bad response",
+			Status:     http.StatusBadGateway,
+			Detail:     "Pastry API returned an invalid response",
+			retryAfter: defaultRetryAfter,
+		}
+	}
+
+	return &problem{
+		Type:   InternalErrorProblem,
+		Title:  "Internal error",
+		Status: http.StatusInternalServerError,
+		Detail: "Request could not be processed, please retry later",
+	}
+}
+
+// traceID identifies a request in responses and logs. It is the trace ID of the current
+// span, or the ID given by LogRequests, or the trace ID of a W3C traceparent header, or an
+// X-Request-ID header, or a generated one.
+func traceID(r *http.Request) string {
+	if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+		return spanContext.TraceID().String()
+	}
+	if requestID := logging.RequestID(r.Context()); requestID != "" {
+		return requestID
+	}
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	if requestID := r.Header.Get("X-Request-ID"); requestID != "" {
+		return requestID
+	}
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
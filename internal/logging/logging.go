@@ -0,0 +1,132 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging builds the structured logger of the application. Records logged with a
+// context carry the request, correlation and trace IDs of that context, so that the path of
+// a request or an order can be followed across components.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Output formats of New.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// CorrelationIDHeader is the HTTP and Kafka header carrying correlation IDs.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// New creates a logger writing records of level or above to w, in format.
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expecting %s or %s", format, FormatText, FormatJSON)
+	}
+	return slog.New(NewContextHandler(handler)), nil
+}
+
+// ParseLevel parses a level name such as debug, info, warn or error.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	correlationIDKey
+	attrsKey
+)
+
+// WithRequestID returns ctx identifying the HTTP request being served.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID of the HTTP request of ctx, or an empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithCorrelationID returns ctx correlated with id. Correlation IDs follow orders from the
+// request placing them to the messages about them.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey, id)
+}
+
+// CorrelationID returns the correlation ID of ctx, or an empty string.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey).(string)
+	return id
+}
+
+// WithAttrs returns ctx adding attrs, such as an order ID, to records logged with it.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	previous, _ := ctx.Value(attrsKey).([]slog.Attr)
+	return context.WithValue(ctx, attrsKey, append(previous[:len(previous):len(previous)], attrs...))
+}
+
+// contextHandler adds IDs and attributes of the context to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+// NewContextHandler wraps handler so that records logged with a context carry its request,
+// correlation and trace IDs, and attributes added with WithAttrs.
+func NewContextHandler(handler slog.Handler) slog.Handler {
+	return &contextHandler{Handler: handler}
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if id := CorrelationID(ctx); id != "" {
+		record.AddAttrs(slog.String("correlation_id", id))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()))
+	}
+	if attrs, ok := ctx.Value(attrsKey).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
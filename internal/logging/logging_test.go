@@ -0,0 +1,92 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewJSONWithContext(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := logging.New(&buffer, "json", slog.LevelInfo)
+	require.NoError(t, err)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+	ctx = logging.WithCorrelationID(logging.WithRequestID(ctx, "request-1"), "correlation-1")
+	ctx = logging.WithAttrs(ctx, slog.String("order_id", "order-1"))
+
+	logger.InfoContext(ctx, "Order created", "status", "CREATED")
+	logger.DebugContext(ctx, "Not logged")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &record))
+	assert.Equal(t, "INFO", record["level"])
+	assert.Equal(t, "Order created", record["msg"])
+	assert.Equal(t, "CREATED", record["status"])
+	assert.Equal(t, "request-1", record["request_id"])
+	assert.Equal(t, "correlation-1", record["correlation_id"])
+	assert.Equal(t, "order-1", record["order_id"])
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", record["trace_id"])
+	assert.Equal(t, "00f067aa0ba902b7", record["span_id"])
+}
+
+func TestNewText(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := logging.New(&buffer, "text", slog.LevelDebug)
+	require.NoError(t, err)
+
+	logger.DebugContext(logging.WithRequestID(context.Background(), "request-1"), "Request served")
+	assert.Contains(t, buffer.String(), `level=DEBUG msg="Request served" request_id=request-1`)
+}
+
+func TestNewUnknownFormat(t *testing.T) {
+	_, err := logging.New(&bytes.Buffer{}, "xml", slog.LevelInfo)
+	assert.Error(t, err)
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := logging.ParseLevel("warn")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+
+	_, err = logging.ParseLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestWithAttrsDoesNotShareAttributes(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := logging.New(&buffer, "json", slog.LevelInfo)
+	require.NoError(t, err)
+
+	parent := logging.WithAttrs(context.Background(), slog.String("a", "1"))
+	_ = logging.WithAttrs(parent, slog.String("b", "2"))
+	logger.InfoContext(parent, "Parent")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &record))
+	assert.Equal(t, "1", record["a"])
+	assert.NotContains(t, record, "b")
+}
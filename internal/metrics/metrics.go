@@ -0,0 +1,119 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics holds the Prometheus collectors of the application.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const namespace = "order_service"
+
+// Outcomes of placed orders.
+const (
+	OrderCreated     = "created"
+	OrderUnavailable = "unavailable"
+	OrderError       = "error"
+)
+
+// Results of Kafka deliveries and of consumed messages.
+const (
+	DeliverySuccess = "success"
+	DeliveryFailure = "failure"
+
+	MessageProcessed = "processed"
+	MessageRetried   = "retried"
+	// MessageDropped counts messages given up after retries, committed without being applied.
+	MessageDropped = "dropped"
+)
+
+// Metrics holds the collectors instrumenting controllers, services and clients.
+type Metrics struct {
+	// HTTPRequests counts served requests by route, method and status code.
+	HTTPRequests *prometheus.CounterVec
+	// HTTPRequestDuration observes served requests latency by route, method and status code.
+	HTTPRequestDuration *prometheus.HistogramVec
+	// OrdersPlaced counts attempts to place an order by outcome.
+	OrdersPlaced *prometheus.CounterVec
+	// PastryAPIRequestDuration observes Pastry API calls latency, retries included, by operation.
+	PastryAPIRequestDuration *prometheus.HistogramVec
+	// PastryAPIErrors counts failed Pastry API calls by operation and kind of error.
+	PastryAPIErrors *prometheus.CounterVec
+	// KafkaDeliveries counts delivery reports of published messages by topic and result.
+	KafkaDeliveries *prometheus.CounterVec
+	// KafkaMessagesConsumed counts consumed messages by topic and result.
+	KafkaMessagesConsumed *prometheus.CounterVec
+	// KafkaConsumerLag is the number of messages not consumed yet by topic and partition.
+	KafkaConsumerLag *prometheus.GaugeVec
+}
+
+// New creates the collectors and registers them with registerer, unless it is nil.
+func New(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		HTTPRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests served.",
+		}, []string{"route", "method", "code"}),
+		HTTPRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests served.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		OrdersPlaced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "orders_placed_total",
+			Help:      "Number of attempts to place an order, by outcome.",
+		}, []string{"outcome"}),
+		PastryAPIRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "pastry_api_request_duration_seconds",
+			Help:      "Latency of Pastry API calls, retries included.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		PastryAPIErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pastry_api_errors_total",
+			Help:      "Number of failed Pastry API calls, by kind of error.",
+		}, []string{"operation", "kind"}),
+		KafkaDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kafka_deliveries_total",
+			Help:      "Number of delivery reports of published messages, by result.",
+		}, []string{"topic", "result"}),
+		KafkaMessagesConsumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kafka_messages_consumed_total",
+			Help:      "Number of consumed messages, by result.",
+		}, []string{"topic", "result"}),
+		KafkaConsumerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "kafka_consumer_lag",
+			Help:      "Number of messages not consumed yet.",
+		}, []string{"topic", "partition"}),
+	}
+	if registerer != nil {
+		registerer.MustRegister(
+			m.HTTPRequests,
+			m.HTTPRequestDuration,
+			m.OrdersPlaced,
+			m.PastryAPIRequestDuration,
+			m.PastryAPIErrors,
+			m.KafkaDeliveries,
+			m.KafkaMessagesConsumed,
+			m.KafkaConsumerLag,
+		)
+	}
+	return m
+}
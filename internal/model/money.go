@@ -0,0 +1,176 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// USD is the ISO 4217 code of US Dollar, the currency of Pastry API prices.
+const USD = "USD"
+
+// minorUnitsPerMajor is the number of minor units (cents) in a currency unit. All
+// currencies we deal with have 2 decimals.
+const minorUnitsPerMajor = 100
+
+// Money is an exact amount of money, expressed in minor units of an ISO 4217 currency.
+// It is serialized in JSON as a plain decimal number of currency units (ex: 9.4) for
+// compatibility with existing contracts, the currency being implied as USD.
+type Money struct {
+	MinorUnits int64
+	Currency   string
+}
+
+// NewMoney creates an amount of minorUnits of currency.
+func NewMoney(minorUnits int64, currency string) Money {
+	return Money{MinorUnits: minorUnits, Currency: currency}
+}
+
+// ParseMoney parses a decimal amount of currency units (ex: "9.40"). Digits beyond
+// minor units are rounded half away from zero.
+func ParseMoney(amount string, currency string) (Money, error) {
+	rat, ok := new(big.Rat).SetString(strings.TrimSpace(amount))
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount of money: %q", amount)
+	}
+
+	// Round half away from zero to minor units.
+	rat.Mul(rat, big.NewRat(minorUnitsPerMajor, 1))
+	quotient, remainder := new(big.Int).QuoRem(rat.Num(), rat.Denom(), new(big.Int))
+	if new(big.Int).Mul(remainder.Abs(remainder), big.NewInt(2)).Cmp(rat.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(rat.Sign())))
+	}
+	if !quotient.IsInt64() {
+		return Money{}, fmt.Errorf("amount of money out of range: %q", amount)
+	}
+	return NewMoney(quotient.Int64(), currency), nil
+}
+
+// ErrCurrencyMismatch is returned by operations between amounts of different currencies.
+var ErrCurrencyMismatch = errors.New("currencies differ")
+
+// Add returns the sum of m and other, or ErrCurrencyMismatch if they are of different currencies.
+func (m Money) Add(other Money) (Money, error) {
+	currency, err := m.currency(other)
+	if err != nil {
+		return Money{}, fmt.Errorf("cannot add %s to %s: %w", other, m, err)
+	}
+	return Money{MinorUnits: m.MinorUnits + other.MinorUnits, Currency: currency}, nil
+}
+
+// Sub returns the difference of m and other, or ErrCurrencyMismatch if they are of different currencies.
+func (m Money) Sub(other Money) (Money, error) {
+	currency, err := m.currency(other)
+	if err != nil {
+		return Money{}, fmt.Errorf("cannot subtract %s from %s: %w", other, m, err)
+	}
+	return Money{MinorUnits: m.MinorUnits - other.MinorUnits, Currency: currency}, nil
+}
+
+// Multiply returns m times quantity.
+func (m Money) Multiply(quantity int32) Money {
+	return Money{MinorUnits: m.MinorUnits * int64(quantity), Currency: m.Currency}
+}
+
+// Abs returns the absolute value of m.
+func (m Money) Abs() Money {
+	if m.MinorUnits < 0 {
+		return Money{MinorUnits: -m.MinorUnits, Currency: m.Currency}
+	}
+	return m
+}
+
+// Decimal formats m as a decimal amount of currency units with all minor digits (ex: "9.40").
+func (m Money) Decimal() string {
+	sign := ""
+	units := m.MinorUnits
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, units/minorUnitsPerMajor, units%minorUnitsPerMajor)
+}
+
+// String formats m with its currency (ex: "9.40 USD").
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.Currency
+}
+
+// MarshalJSON writes m as the shortest decimal number of currency units (ex: 9.4).
+func (m Money) MarshalJSON() ([]byte, error) {
+	decimal := strings.TrimRight(strings.TrimRight(m.Decimal(), "0"), ".")
+	if decimal == "" || decimal == "-" {
+		decimal = "0"
+	}
+	return []byte(decimal), nil
+}
+
+// UnmarshalJSON reads a decimal number of currency units, in USD.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(string(data), 64); err != nil {
+		// Let encoding/json tell which field is wrong.
+		return &json.UnmarshalTypeError{Value: jsonKind(data), Type: reflect.TypeOf(m).Elem()}
+	}
+	money, err := ParseMoney(string(data), USD)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+// currency returns the currency of an operation between m and other, an empty currency
+// being the one of the other operand.
+func (m Money) currency(other Money) (string, error) {
+	switch {
+	case m.Currency == "":
+		return other.Currency, nil
+	case other.Currency == "" || other.Currency == m.Currency:
+		return m.Currency, nil
+	default:
+		return "", ErrCurrencyMismatch
+	}
+}
+
+// jsonKind describes the kind of a JSON value, as encoding/json does in its errors.
+func jsonKind(data []byte) string {
+	switch {
+	case len(data) == 0:
+		return "value"
+	case data[0] == '"':
+		return "string"
+	case data[0] == '{':
+		return "object"
+	case data[0] == '[':
+		return "array"
+	case data[0] == 't' || data[0] == 'f':
+		return "bool"
+	default:
+		return "number"
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoneyArithmeticIsExact(t *testing.T) {
+	// 0.1 + 0.2 is not 0.3 with floats.
+	dime, err := model.ParseMoney("0.1", model.USD)
+	require.NoError(t, err)
+	twoDimes, err := model.ParseMoney("0.2", model.USD)
+	require.NoError(t, err)
+	sum, err := dime.Add(twoDimes)
+	require.NoError(t, err)
+	require.Equal(t, model.NewMoney(30, model.USD), sum)
+
+	total, err := model.NewMoney(440, model.USD).Add(model.NewMoney(250, model.USD).Multiply(2))
+	require.NoError(t, err)
+	require.Equal(t, model.NewMoney(940, model.USD), total)
+	require.Equal(t, "9.40 USD", total.String())
+	difference, err := model.NewMoney(5, model.USD).Sub(model.NewMoney(10, model.USD))
+	require.NoError(t, err)
+	require.Equal(t, "-0.05", difference.Decimal())
+}
+
+func TestMoneyArithmeticRejectsMixedCurrencies(t *testing.T) {
+	dollars, euros := model.NewMoney(440, model.USD), model.NewMoney(400, "EUR")
+	_, err := dollars.Add(euros)
+	require.ErrorIs(t, err, model.ErrCurrencyMismatch)
+	_, err = dollars.Sub(euros)
+	require.ErrorIs(t, err, model.ErrCurrencyMismatch)
+
+	// An amount without currency takes the one of the other operand.
+	sum, err := model.Money{}.Add(euros)
+	require.NoError(t, err)
+	require.Equal(t, euros, sum)
+}
+
+func TestParseMoneyRoundsToMinorUnits(t *testing.T) {
+	for amount, minorUnits := range map[string]int64{
+		"9.4":    940,
+		"9.405":  941,
+		"9.4049": 940,
+		"-1.005": -101,
+		"1e2":    10000,
+	} {
+		money, err := model.ParseMoney(amount, model.USD)
+		require.NoError(t, err, amount)
+		require.Equal(t, minorUnits, money.MinorUnits, amount)
+	}
+
+	_, err := model.ParseMoney("nine", model.USD)
+	require.Error(t, err)
+}
+
+func TestMoneyJSONIsANumber(t *testing.T) {
+	info := model.OrderInfo{CustomerID: "lbroudoux", TotalPrice: model.NewMoney(940, model.USD)}
+	data, err := json.Marshal(info)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"customerId": "lbroudoux", "productQuantities": null, "totalPrice": 9.4}`, string(data))
+
+	for amount, expected := range map[string]string{"0": "0", "5": "0.05", "-250": "-2.5", "1200": "12"} {
+		var minorUnits int64
+		require.NoError(t, json.Unmarshal([]byte(amount), &minorUnits))
+		data, err := json.Marshal(model.NewMoney(minorUnits, model.USD))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(data))
+	}
+
+	var decoded model.OrderInfo
+	require.NoError(t, json.Unmarshal([]byte(`{"totalPrice": 6.9}`), &decoded))
+	require.Equal(t, model.NewMoney(690, model.USD), decoded.TotalPrice)
+
+	require.Error(t, json.Unmarshal([]byte(`{"totalPrice": "6.9"}`), &decoded))
+}
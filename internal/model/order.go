@@ -22,7 +22,13 @@ type ProductQuantity struct {
 type OrderInfo struct {
 	CustomerID        string            `json:"customerId"`
 	ProductQuantities []ProductQuantity `json:"productQuantities"`
-	TotalPrice        float32           `json:"totalPrice"`
+	TotalPrice        Money             `json:"totalPrice"`
+}
+
+// OrderAmendment holds the new products of an order and their total price.
+type OrderAmendment struct {
+	ProductQuantities []ProductQuantity `json:"productQuantities"`
+	TotalPrice        Money             `json:"totalPrice"`
 }
 
 type Status string
@@ -34,6 +40,11 @@ const (
 	FAILED    Status = "FAILED"
 )
 
+// Terminal tells if an order with this status cannot change anymore.
+func (s Status) Terminal() bool {
+	return s == CANCELED || s == FAILED
+}
+
 type Order struct {
 	OrderInfo
 	ID     string `json:"id"`
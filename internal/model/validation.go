@@ -0,0 +1,63 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError tells why a field of a request is invalid. Field is the JSON path of the
+// field (ex: productQuantities[1].quantity), empty if the whole request is invalid.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// Validate checks that info holds everything needed to place an order. Errors of all
+// invalid fields are returned, none if info is valid.
+func (info *OrderInfo) Validate() []FieldError {
+	var errs []FieldError
+	if strings.TrimSpace(info.CustomerID) == "" {
+		errs = append(errs, FieldError{Field: "customerId", Message: "is required"})
+	}
+	return append(errs, validateProducts(info.ProductQuantities, info.TotalPrice)...)
+}
+
+// Validate checks that amendment holds everything needed to amend an order. Errors of all
+// invalid fields are returned, none if amendment is valid.
+func (amendment *OrderAmendment) Validate() []FieldError {
+	return validateProducts(amendment.ProductQuantities, amendment.TotalPrice)
+}
+
+// validateProducts checks the ordered products and their total price.
+func validateProducts(productQuantities []ProductQuantity, totalPrice Money) []FieldError {
+	var errs []FieldError
+	if len(productQuantities) == 0 {
+		errs = append(errs, FieldError{Field: "productQuantities", Message: "must contain at least one product"})
+	}
+	for i, productQuantity := range productQuantities {
+		if strings.TrimSpace(productQuantity.ProductName) == "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("productQuantities[%d].productName", i), Message: "is required"})
+		}
+		if productQuantity.Quantity <= 0 {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("productQuantities[%d].quantity", i), Message: "must be positive"})
+		}
+	}
+	if totalPrice.MinorUnits <= 0 {
+		errs = append(errs, FieldError{Field: "totalPrice", Message: "must be positive"})
+	}
+	return errs
+}
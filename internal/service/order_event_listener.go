@@ -18,21 +18,30 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OrderEventListener is the service interface for listening order events.
 type OrderEventListener interface {
 	// Listen starts listening to the Kafka topic and returns a channel that will be closed when listening stops
 	Listen(ctx context.Context) (<-chan struct{}, error)
-	// Stop gracefully stops listening to the Kafka topic
+	// Stop gracefully stops listening to the Kafka topic once the message being processed is committed
 	Stop()
+	// Running tells if messages of the Kafka topic are being processed
+	Running() bool
 }
 
 type orderEventListener struct {
@@ -43,6 +52,9 @@ type orderEventListener struct {
 	wg            sync.WaitGroup
 	mu            sync.Mutex
 	isRunning     bool
+	metrics       *metrics.Metrics
+	config        OrderEventListenerConfig
+	logger        *slog.Logger
 }
 
 // OrderEventListenerConfig Configuration options for the listener.
@@ -53,21 +65,53 @@ type OrderEventListenerConfig struct {
 	MessageTimeout time.Duration
 }
 
-// Default configuration values.
+// Default configuration values. MessageTimeout is short as it bounds how long Stop waits for
+// the current poll.
 var defaultConfig = OrderEventListenerConfig{
 	MaxRetries:     3,
 	RetryBackoff:   time.Second * 2,
 	CommitInterval: time.Second * 5,
-	MessageTimeout: time.Second * 30,
+	MessageTimeout: time.Second,
 }
 
-func NewOrderEventListener(kafkaConsumer *kafka.Consumer, kafkaTopic string, orderService OrderService) OrderEventListener {
-	return &orderEventListener{
+// OrderEventListenerOption allows customizing an OrderEventListener built with NewOrderEventListener.
+type OrderEventListenerOption func(*orderEventListener)
+
+// WithListenerConfig replaces the default retries and timeouts of the listener.
+func WithListenerConfig(config OrderEventListenerConfig) OrderEventListenerOption {
+	return func(l *orderEventListener) {
+		l.config = config
+	}
+}
+
+// WithListenerLogger sets the logger of the listener.
+func WithListenerLogger(logger *slog.Logger) OrderEventListenerOption {
+	return func(l *orderEventListener) {
+		l.logger = logger
+	}
+}
+
+// WithListenerMetrics sets the collectors observing consumed messages and consumer lag.
+func WithListenerMetrics(m *metrics.Metrics) OrderEventListenerOption {
+	return func(l *orderEventListener) {
+		l.metrics = m
+	}
+}
+
+func NewOrderEventListener(kafkaConsumer *kafka.Consumer, kafkaTopic string, orderService OrderService, opts ...OrderEventListenerOption) OrderEventListener {
+	l := &orderEventListener{
 		kafkaConsumer: kafkaConsumer,
 		kafkaTopic:    kafkaTopic,
 		orderService:  orderService,
 		done:          make(chan struct{}),
+		metrics:       metrics.New(nil),
+		config:        defaultConfig,
+		logger:        slog.Default(),
 	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
 }
 
 func (l *orderEventListener) Listen(ctx context.Context) (<-chan struct{}, error) {
@@ -81,6 +125,9 @@ func (l *orderEventListener) Listen(ctx context.Context) (<-chan struct{}, error
 
 	err := l.kafkaConsumer.Subscribe(l.kafkaTopic, nil)
 	if err != nil {
+		l.mu.Lock()
+		l.isRunning = false
+		l.mu.Unlock()
 		return nil, fmt.Errorf("failed to subscribe to topic %s: %w", l.kafkaTopic, err)
 	}
 
@@ -95,39 +142,45 @@ func (l *orderEventListener) Listen(ctx context.Context) (<-chan struct{}, error
 			l.mu.Unlock()
 			l.wg.Done()
 			close(finished)
-			log.Println("Kafka listener stopped")
+			l.logger.Info("Kafka listener stopped", "topic", l.kafkaTopic)
 		}()
 
 		for {
 			select {
 			case <-ctx.Done():
-				log.Println("Context cancelled, stopping listener")
+				l.logger.Info("Context cancelled, stopping listener", "topic", l.kafkaTopic)
 				return
 			case <-l.done:
-				log.Println("Received stop signal, stopping listener")
+				l.logger.Info("Received stop signal, stopping listener", "topic", l.kafkaTopic)
 				return
 			default:
-				message, err := l.kafkaConsumer.ReadMessage(defaultConfig.MessageTimeout)
+				message, err := l.kafkaConsumer.ReadMessage(l.config.MessageTimeout)
 				if err != nil {
 					if err.(kafka.Error).Code() == kafka.ErrTimedOut {
 						continue
 					}
-					log.Printf("Error reading message: %v", err)
+					l.logger.Error("Error reading message", "topic", l.kafkaTopic, "error", err)
 					continue
 				}
 
 				if err := l.processMessage(message); err != nil {
-					log.Printf("Error processing message: %v", err)
+					l.logger.Warn("Error processing message", messageAttrs(message), "error", err)
 					// Implement retry logic with backoff
 					if retryErr := l.retryProcessMessage(message); retryErr != nil {
-						log.Printf("Failed to process message after retries: %v", retryErr)
-						// Consider implementing dead letter queue here
+						l.logger.Error("Failed to process message after retries", messageAttrs(message), "error", retryErr)
+						// There is no dead letter topic: the message is dropped once committed.
+						l.metrics.KafkaMessagesConsumed.WithLabelValues(l.kafkaTopic, metrics.MessageDropped).Inc()
+					} else {
+						l.metrics.KafkaMessagesConsumed.WithLabelValues(l.kafkaTopic, metrics.MessageProcessed).Inc()
 					}
+				} else {
+					l.metrics.KafkaMessagesConsumed.WithLabelValues(l.kafkaTopic, metrics.MessageProcessed).Inc()
 				}
+				l.observeLag(message.TopicPartition)
 
 				// Commit the message offset
 				if _, err := l.kafkaConsumer.CommitMessage(message); err != nil {
-					log.Printf("Failed to commit message: %v", err)
+					l.logger.Error("Failed to commit message", messageAttrs(message), "error", err)
 				}
 			}
 		}
@@ -136,38 +189,84 @@ func (l *orderEventListener) Listen(ctx context.Context) (<-chan struct{}, error
 	return finished, nil
 }
 
-func (l *orderEventListener) processMessage(message *kafka.Message) error {
+// processMessage applies a review, resuming the trace and correlation propagated in message headers.
+func (l *orderEventListener) processMessage(message *kafka.Message) (err error) {
 	if message == nil {
 		return errors.New("received nil message")
 	}
 
-	log.Printf("Processing message from topic %s [%d] at offset %v: key = %s\n",
-		*message.TopicPartition.Topic, message.TopicPartition.Partition,
-		message.TopicPartition.Offset, string(message.Key))
+	ctx, span := tracing.Tracer().Start(tracing.ExtractKafka(context.Background(), message), "OrderEventListener.processMessage",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", *message.TopicPartition.Topic),
+			attribute.Int("messaging.destination.partition.id", int(message.TopicPartition.Partition)),
+			attribute.Int64("messaging.kafka.message.offset", int64(message.TopicPartition.Offset))))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "processing failed")
+		}
+		span.End()
+	}()
+
+	for _, header := range message.Headers {
+		if header.Key == logging.CorrelationIDHeader {
+			ctx = logging.WithCorrelationID(ctx, string(header.Value))
+		}
+	}
+	l.logger.DebugContext(ctx, "Processing message", messageAttrs(message), "key", string(message.Key))
 
 	var orderEvent model.OrderEvent
 	if err := json.Unmarshal(message.Value, &orderEvent); err != nil {
 		return fmt.Errorf("failed to unmarshal message value: %w", err)
 	}
 
+	ctx = logging.WithAttrs(ctx, slog.String("order_id", orderEvent.Order.ID))
 	order := l.orderService.UpdateReviewedOrder(&orderEvent)
-	log.Printf("Order '%s' has been updated after review", order.ID)
+	span.SetAttributes(attribute.String("order.id", order.ID))
+	l.logger.InfoContext(ctx, "Order has been updated after review", "status", order.Status, "reason", orderEvent.ChangeReason)
 	return nil
 }
 
 func (l *orderEventListener) retryProcessMessage(message *kafka.Message) error {
 	var lastErr error
-	for i := range defaultConfig.MaxRetries {
-		time.Sleep(defaultConfig.RetryBackoff * time.Duration(i+1))
+	for i := range l.config.MaxRetries {
+		time.Sleep(l.config.RetryBackoff * time.Duration(i+1))
+		l.metrics.KafkaMessagesConsumed.WithLabelValues(l.kafkaTopic, metrics.MessageRetried).Inc()
 
 		if err := l.processMessage(message); err != nil {
 			lastErr = err
-			log.Printf("Retry %d/%d failed: %v", i+1, defaultConfig.MaxRetries, err)
+			l.logger.Warn("Retry failed", messageAttrs(message), "attempt", i+1, "maxRetries", l.config.MaxRetries, "error", err)
 			continue
 		}
 		return nil
 	}
-	return fmt.Errorf("failed after %d retries, last error: %w", defaultConfig.MaxRetries, lastErr)
+	return fmt.Errorf("failed after %d retries, last error: %w", l.config.MaxRetries, lastErr)
+}
+
+// messageAttrs groups the position of message for logs.
+func messageAttrs(message *kafka.Message) slog.Attr {
+	return slog.Group("message",
+		slog.String("topic", *message.TopicPartition.Topic),
+		slog.Int("partition", int(message.TopicPartition.Partition)),
+		slog.Int64("offset", int64(message.TopicPartition.Offset)))
+}
+
+// observeLag records how many messages of the partition of a consumed message are left,
+// from the watermark offsets the consumer already knows.
+func (l *orderEventListener) observeLag(partition kafka.TopicPartition) {
+	_, high, err := l.kafkaConsumer.GetWatermarkOffsets(*partition.Topic, partition.Partition)
+	if err != nil || high < 0 {
+		return
+	}
+	lag := max(high-int64(partition.Offset)-1, 0)
+	l.metrics.KafkaConsumerLag.WithLabelValues(*partition.Topic, strconv.Itoa(int(partition.Partition))).Set(float64(lag))
+}
+
+func (l *orderEventListener) Running() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.isRunning
 }
 
 func (l *orderEventListener) Stop() {
@@ -190,6 +289,6 @@ func (l *orderEventListener) Stop() {
 	}
 
 	if err := l.kafkaConsumer.Close(); err != nil {
-		log.Printf("Error closing Kafka consumer: %v", err)
+		l.logger.Error("Error closing Kafka consumer", "error", err)
 	}
 }
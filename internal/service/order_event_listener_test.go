@@ -0,0 +1,42 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerNotRunningWhenSubscriptionFails(t *testing.T) {
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cluster.BootstrapServers(),
+		"group.id":          "order-service",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = consumer.Close() })
+	// An invalid regular expression cannot be subscribed to.
+	listener := service.NewOrderEventListener(consumer, "^orders-[", service.NewOrderService(newPastryAPI(), &stubPublisher{}))
+
+	_, err = listener.Listen(context.Background())
+	require.ErrorContains(t, err, "failed to subscribe to topic")
+	require.False(t, listener.Running())
+}
@@ -15,75 +15,156 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/logging"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OrderEventPublisher is the service interface for publishing order events.
 type OrderEventPublisher interface {
-	// Publish a new order event.
-	PublishOrderEvent(event *model.OrderEvent) (*model.OrderEvent, error)
+	// Publish a new order event, propagating the trace context of ctx in message headers. It
+	// returns once the event is delivered, or with the error that prevented its delivery.
+	PublishOrderEvent(ctx context.Context, event *model.OrderEvent) (*model.OrderEvent, error)
 }
 
 type orderEventPublisher struct {
 	kafkaProducer *kafka.Producer
 	kafkaTopic    string
+	// reasonTopics are the topics of events whose change reason is not published on kafkaTopic.
+	reasonTopics map[string]string
+	metrics      *metrics.Metrics
+	logger       *slog.Logger
 }
 
-func NewOrderEventPublisher(kafkaProducer *kafka.Producer, kafkaTopic string) OrderEventPublisher {
+// OrderEventPublisherOption allows customizing an OrderEventPublisher built with NewOrderEventPublisher.
+type OrderEventPublisherOption func(*orderEventPublisher)
+
+// WithPublisherLogger sets the logger of the publisher and of its delivery reports.
+func WithPublisherLogger(logger *slog.Logger) OrderEventPublisherOption {
+	return func(oep *orderEventPublisher) {
+		oep.logger = logger
+	}
+}
+
+// WithReasonTopic publishes events of changeReason on topic instead of the default topic.
+func WithReasonTopic(changeReason, topic string) OrderEventPublisherOption {
+	return func(oep *orderEventPublisher) {
+		oep.reasonTopics[changeReason] = topic
+	}
+}
+
+// WithPublisherMetrics sets the collectors observing delivery reports.
+func WithPublisherMetrics(m *metrics.Metrics) OrderEventPublisherOption {
+	return func(oep *orderEventPublisher) {
+		oep.metrics = m
+	}
+}
+
+func NewOrderEventPublisher(kafkaProducer *kafka.Producer, kafkaTopic string, opts ...OrderEventPublisherOption) OrderEventPublisher {
+	oep := &orderEventPublisher{
+		kafkaProducer: kafkaProducer,
+		kafkaTopic:    kafkaTopic,
+		reasonTopics:  make(map[string]string),
+		metrics:       metrics.New(nil),
+		logger:        slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(oep)
+	}
+
 	// Listen to all the events on the default events channel
 	go func() {
 		for e := range kafkaProducer.Events() {
 			switch ev := e.(type) {
 			case *kafka.Message:
-				// The message delivery report, indicating success or permanent failure after retries have been exhausted.
-				// Application level retries won't help since the client is already configured to do that.
-				m := ev
-				if m.TopicPartition.Error != nil {
-					fmt.Printf("Delivery failed: %v\n", m.TopicPartition.Error)
-				} else {
-					fmt.Printf("Delivered message to topic %s [%d] at offset %v\n",
-						*m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
-				}
+				// Delivery reports of messages produced by PublishOrderEvent go to their own channel.
+				oep.observeDelivery(context.Background(), ev)
 			case kafka.Error:
 				// Generic client instance-level errors, such as broker connection failures, authentication issues, etc.
 				// These errors should generally be considered informational as the underlying client will automatically try to
 				// recover from any errors encountered, the application does not need to take action on them.
-				fmt.Printf("Error: %v\n", ev)
+				oep.logger.Warn("Kafka producer error", "error", ev)
 			default:
-				fmt.Printf("Ignored event: %s\n", ev)
+				oep.logger.Debug("Ignored event", "event", ev.String())
 			}
 		}
 	}()
 
-	return &orderEventPublisher{
-		kafkaProducer: kafkaProducer,
-		kafkaTopic:    kafkaTopic,
-	}
+	return oep
 }
 
 // PublishOrderEvent.
-func (oep *orderEventPublisher) PublishOrderEvent(event *model.OrderEvent) (*model.OrderEvent, error) {
+func (oep *orderEventPublisher) PublishOrderEvent(ctx context.Context, event *model.OrderEvent) (*model.OrderEvent, error) {
+	topic, ok := oep.reasonTopics[event.ChangeReason]
+	if !ok {
+		topic = oep.kafkaTopic
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "OrderEventPublisher.PublishOrderEvent",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("order.id", event.Order.ID)))
+	defer span.End()
+
 	// Serailize OrderEvent in JSON.
 	eventJSON, err := json.Marshal(event)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "serialization failed")
 		return nil, err
 	}
 
-	// Publish on Kafka topic.
-	err = oep.kafkaProducer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &oep.kafkaTopic, Partition: kafka.PartitionAny},
+	// Publish on Kafka topic, with trace context and correlation ID so that consumers can resume them.
+	ctx = logging.WithAttrs(ctx, slog.String("order_id", event.Order.ID))
+	message := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
 		Value:          eventJSON,
-	}, nil)
+	}
+	if correlationID := logging.CorrelationID(ctx); correlationID != "" {
+		message.Headers = append(message.Headers, kafka.Header{Key: logging.CorrelationIDHeader, Value: []byte(correlationID)})
+	}
+	tracing.InjectKafka(ctx, message)
+	deliveries := make(chan kafka.Event, 1)
+	err = oep.kafkaProducer.Produce(message, deliveries)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "produce failed")
 		return nil, err
 	}
 
-	numMsg := oep.kafkaProducer.Flush(750)
-	fmt.Println("Send", numMsg, "Kafka messages")
+	// Wait for the delivery report, whatever ctx, so that callers only undo changes of events
+	// that are not delivered. Its delay is bounded by message.timeout.ms of the producer.
+	delivered := (<-deliveries).(*kafka.Message)
+	oep.observeDelivery(ctx, delivered)
+	if err := delivered.TopicPartition.Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "delivery failed")
+		return nil, fmt.Errorf("failed to deliver order event on %s: %w", topic, err)
+	}
+	oep.logger.DebugContext(ctx, "Published order event", "topic", topic, "reason", event.ChangeReason)
 
 	return event, nil
 }
+
+// observeDelivery records the delivery report of message, indicating success or permanent
+// failure after retries have been exhausted. Application level retries won't help since the
+// client is already configured to do that.
+func (oep *orderEventPublisher) observeDelivery(ctx context.Context, message *kafka.Message) {
+	if message.TopicPartition.Error != nil {
+		oep.metrics.KafkaDeliveries.WithLabelValues(*message.TopicPartition.Topic, metrics.DeliveryFailure).Inc()
+		oep.logger.ErrorContext(ctx, "Delivery failed", "topic", *message.TopicPartition.Topic, "error", message.TopicPartition.Error)
+	} else {
+		oep.metrics.KafkaDeliveries.WithLabelValues(*message.TopicPartition.Topic, metrics.DeliverySuccess).Inc()
+		oep.logger.DebugContext(ctx, "Delivered message", messageAttrs(message))
+	}
+}
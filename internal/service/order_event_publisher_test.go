@@ -0,0 +1,106 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/stretchr/testify/require"
+)
+
+// newMockProducer creates a producer of an in-process mock cluster having topics.
+func newMockProducer(t *testing.T, topics ...string) (*kafka.Producer, *kafka.MockCluster) {
+	t.Helper()
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	for _, topic := range topics {
+		require.NoError(t, cluster.CreateTopic(topic, 1, 1))
+	}
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": cluster.BootstrapServers()})
+	require.NoError(t, err)
+	t.Cleanup(producer.Close)
+	return producer, cluster
+}
+
+// readEvents reads count order events of topic from its beginning.
+func readEvents(t *testing.T, cluster *kafka.MockCluster, topic string, count int) []model.OrderEvent {
+	t.Helper()
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cluster.BootstrapServers(),
+		"group.id":          topic + "-reader",
+		"auto.offset.reset": "earliest",
+	})
+	require.NoError(t, err)
+	defer consumer.Close()
+	require.NoError(t, consumer.Subscribe(topic, nil))
+
+	var events []model.OrderEvent
+	for len(events) < count {
+		message, err := consumer.ReadMessage(5 * time.Second)
+		require.NoError(t, err)
+		var event model.OrderEvent
+		require.NoError(t, json.Unmarshal(message.Value, &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestPublishOrderEventRoutesChangeReasons(t *testing.T) {
+	producer, cluster := newMockProducer(t, "orders-created", "orders-failed")
+	publisher := service.NewOrderEventPublisher(producer, "orders-created",
+		service.WithReasonTopic(service.ReviewTimeoutReason, "orders-failed"))
+
+	order := model.Order{ID: "123-456-789", Status: model.CREATED}
+	_, err := publisher.PublishOrderEvent(context.Background(), &model.OrderEvent{Order: order, ChangeReason: "Creation"})
+	require.NoError(t, err)
+	order.Status = model.FAILED
+	_, err = publisher.PublishOrderEvent(context.Background(), &model.OrderEvent{Order: order, ChangeReason: service.ReviewTimeoutReason})
+	require.NoError(t, err)
+
+	created := readEvents(t, cluster, "orders-created", 1)
+	require.Equal(t, "Creation", created[0].ChangeReason)
+	failed := readEvents(t, cluster, "orders-failed", 1)
+	require.Equal(t, service.ReviewTimeoutReason, failed[0].ChangeReason)
+	require.Equal(t, model.FAILED, failed[0].Order.Status)
+}
+
+func TestPublishOrderEventReturnsDeliveryFailures(t *testing.T) {
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	require.NoError(t, cluster.CreateTopic("orders-created", 1, 1))
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  cluster.BootstrapServers(),
+		"message.timeout.ms": 200,
+	})
+	require.NoError(t, err)
+	t.Cleanup(producer.Close)
+	publisher := service.NewOrderEventPublisher(producer, "orders-created")
+
+	// The event is only reported as published once delivered.
+	require.NoError(t, cluster.SetBrokerDown(1))
+	_, err = publisher.PublishOrderEvent(context.Background(), &model.OrderEvent{Order: model.Order{ID: "123-456-789"}, ChangeReason: "Creation"})
+	var kafkaErr kafka.Error
+	require.ErrorAs(t, err, &kafkaErr)
+	require.Equal(t, kafka.ErrMsgTimedOut, kafkaErr.Code())
+	require.Zero(t, producer.Len())
+}
@@ -0,0 +1,200 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+)
+
+// OrderEventReplayer is the service interface for rebuilding orders from past order events.
+type OrderEventReplayer interface {
+	// Replay reads topics from their beginning up to their current end and applies their
+	// events in the order they have been written, whatever their topic. It returns the
+	// number of applied events.
+	Replay(ctx context.Context) (int, error)
+}
+
+type orderEventReplayer struct {
+	kafkaConsumer *kafka.Consumer
+	kafkaTopics   []string
+	orderService  OrderService
+	logger        *slog.Logger
+}
+
+// OrderEventReplayerOption allows customizing an OrderEventReplayer built with NewOrderEventReplayer.
+type OrderEventReplayerOption func(*orderEventReplayer)
+
+// WithReplayerLogger sets the logger reporting replay progress.
+func WithReplayerLogger(logger *slog.Logger) OrderEventReplayerOption {
+	return func(r *orderEventReplayer) {
+		r.logger = logger
+	}
+}
+
+const (
+	// replayReadTimeout is the maximum time to wait for a message while replaying.
+	replayReadTimeout = time.Second
+	// replayProgressInterval is the interval between two progress logs while replaying.
+	replayProgressInterval = 5 * time.Second
+	// replayMetadataTimeout is the maximum time to wait for topics metadata.
+	replayMetadataTimeout = 10 * time.Second
+)
+
+// NewOrderEventReplayer creates a replayer of kafkaTopics. The consumer should belong to a
+// consumer group of its own and not commit offsets, as partitions are read from their
+// beginning anyway.
+func NewOrderEventReplayer(kafkaConsumer *kafka.Consumer, kafkaTopics []string, orderService OrderService, opts ...OrderEventReplayerOption) OrderEventReplayer {
+	r := &orderEventReplayer{
+		kafkaConsumer: kafkaConsumer,
+		kafkaTopics:   kafkaTopics,
+		orderService:  orderService,
+		logger:        slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Replay reads every topic before applying events: a review may only be applied after the
+// events written before it on other topics, such as the review timeout of its order.
+func (r *orderEventReplayer) Replay(ctx context.Context) (int, error) {
+	var events []timedEvent
+	for i, topic := range r.kafkaTopics {
+		topicEvents, err := r.readTopic(ctx, topic)
+		if err != nil {
+			return 0, err
+		}
+		for j := range topicEvents {
+			topicEvents[j].topic = i
+		}
+		events = append(events, topicEvents...)
+		r.logger.InfoContext(ctx, "Read events of topic", "topic", topic, "events", len(topicEvents))
+	}
+
+	slices.SortFunc(events, compareTimedEvents)
+	for _, event := range events {
+		r.orderService.ReplayOrderEvent(event.event)
+	}
+	return len(events), nil
+}
+
+// timedEvent is an event with the time and the position it has been written at in Kafka.
+type timedEvent struct {
+	event     *model.OrderEvent
+	timestamp time.Time
+	// topic is the index of the topic in the topics of the replayer.
+	topic     int
+	partition int32
+	offset    kafka.Offset
+}
+
+// compareTimedEvents orders events by the time they have been written. Events written at
+// the same time are ordered by topic, then by their position in the topic.
+func compareTimedEvents(a, b timedEvent) int {
+	return cmp.Or(
+		a.timestamp.Compare(b.timestamp),
+		cmp.Compare(a.topic, b.topic),
+		cmp.Compare(a.partition, b.partition),
+		cmp.Compare(a.offset, b.offset),
+	)
+}
+
+// readTopic reads events of all partitions of topic, up to their current end.
+func (r *orderEventReplayer) readTopic(ctx context.Context, topic string) ([]timedEvent, error) {
+	metadata, err := r.kafkaConsumer.GetMetadata(&topic, false, int(replayMetadataTimeout.Milliseconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata of topic %s: %w", topic, err)
+	}
+
+	// Remember where each partition currently ends.
+	var assignment []kafka.TopicPartition
+	ends := make(map[int32]kafka.Offset)
+	total := int64(0)
+	for _, partition := range metadata.Topics[topic].Partitions {
+		low, high, err := r.kafkaConsumer.QueryWatermarkOffsets(topic, partition.ID, int(replayMetadataTimeout.Milliseconds()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get offsets of topic %s [%d]: %w", topic, partition.ID, err)
+		}
+		if high > low {
+			assignment = append(assignment, kafka.TopicPartition{Topic: &topic, Partition: partition.ID, Offset: kafka.OffsetBeginning})
+			ends[partition.ID] = kafka.Offset(high)
+			total += high - low
+		}
+	}
+	if len(assignment) == 0 {
+		return nil, nil
+	}
+
+	if err := r.kafkaConsumer.Assign(assignment); err != nil {
+		return nil, fmt.Errorf("failed to assign partitions of topic %s: %w", topic, err)
+	}
+	defer func() {
+		if err := r.kafkaConsumer.Unassign(); err != nil {
+			r.logger.WarnContext(ctx, "Failed to unassign partitions of topic", "topic", topic, "error", err)
+		}
+	}()
+
+	r.logger.InfoContext(ctx, "Replaying messages of topic", "topic", topic, "messages", total)
+	var events []timedEvent
+	read := int64(0)
+	lastProgress := time.Now()
+	for len(ends) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		message, err := r.kafkaConsumer.ReadMessage(replayReadTimeout)
+		if err != nil {
+			if kafkaErr, ok := err.(kafka.Error); ok && kafkaErr.Code() == kafka.ErrTimedOut {
+				continue
+			}
+			return nil, fmt.Errorf("failed to replay topic %s: %w", topic, err)
+		}
+
+		read++
+		partition := message.TopicPartition.Partition
+		if end, ok := ends[partition]; ok && message.TopicPartition.Offset+1 >= end {
+			delete(ends, partition)
+		}
+
+		var event model.OrderEvent
+		if err := json.Unmarshal(message.Value, &event); err != nil {
+			r.logger.WarnContext(ctx, "Skipping unreadable message", messageAttrs(message), "error", err)
+			continue
+		}
+		events = append(events, timedEvent{
+			event:     &event,
+			timestamp: message.Timestamp,
+			partition: partition,
+			offset:    message.TopicPartition.Offset,
+		})
+
+		if time.Since(lastProgress) >= replayProgressInterval {
+			r.logger.InfoContext(ctx, "Replay in progress", "topic", topic, "read", read, "messages", total)
+			lastProgress = time.Now()
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,92 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/stretchr/testify/require"
+)
+
+// writeEvent writes event on topic as if it had been written at timestamp.
+func writeEvent(t *testing.T, producer *kafka.Producer, topic string, timestamp int64, event model.OrderEvent) {
+	t.Helper()
+	value, err := json.Marshal(event)
+	require.NoError(t, err)
+	deliveries := make(chan kafka.Event, 1)
+	require.NoError(t, producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          value,
+		Timestamp:      time.UnixMilli(timestamp),
+	}, deliveries))
+	require.NoError(t, (<-deliveries).(*kafka.Message).TopicPartition.Error)
+}
+
+func TestReplayAppliesEventsOfAllTopicsInWrittenOrder(t *testing.T) {
+	topics := []string{"orders-created", "orders-reviewed", "orders-failed"}
+	producer, cluster := newMockProducer(t, topics...)
+
+	// A late review follows the review timeout of its order.
+	expired := model.Order{ID: "order-1", Status: model.CREATED}
+	writeEvent(t, producer, "orders-created", 1000, model.OrderEvent{Timestamp: 1000, Order: expired, ChangeReason: "Creation"})
+	expired.Status = model.CANCELED
+	writeEvent(t, producer, "orders-reviewed", 4000, model.OrderEvent{Timestamp: 4000, Order: expired, ChangeReason: "Cancellation"})
+	expired.Status = model.FAILED
+	writeEvent(t, producer, "orders-failed", 3000, model.OrderEvent{Timestamp: 3000, Order: expired, ChangeReason: service.ReviewTimeoutReason})
+
+	// Events written at the same time keep their topic and offset order.
+	amended := model.Order{ID: "order-2", Status: model.CREATED, OrderInfo: model.OrderInfo{TotalPrice: usd(440)}}
+	writeEvent(t, producer, "orders-created", 5000, model.OrderEvent{Timestamp: 5000, Order: amended, ChangeReason: "Creation"})
+	amended.TotalPrice = usd(880)
+	writeEvent(t, producer, "orders-created", 5000, model.OrderEvent{Timestamp: 5000, Order: amended, ChangeReason: "Amendment"})
+	validated := amended
+	validated.Status = model.VALIDATED
+	writeEvent(t, producer, "orders-reviewed", 5000, model.OrderEvent{Timestamp: 5000, Order: validated, ChangeReason: "Validation"})
+
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  cluster.BootstrapServers(),
+		"group.id":           "order-replay",
+		"enable.auto.commit": false,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = consumer.Close() })
+	orderService := service.NewOrderService(newPastryAPI(), &stubPublisher{})
+
+	replayed, err := service.NewOrderEventReplayer(consumer, topics, orderService).Replay(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 6, replayed)
+
+	require.Equal(t, model.FAILED, orderService.GetOrder("order-1").Status)
+	history, err := orderService.GetOrderHistory("order-1")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, "Creation", history[0].ChangeReason)
+	require.Equal(t, service.ReviewTimeoutReason, history[1].ChangeReason)
+
+	require.Equal(t, model.VALIDATED, orderService.GetOrder("order-2").Status)
+	require.Equal(t, usd(880), orderService.GetOrder("order-2").TotalPrice)
+	history, err = orderService.GetOrderHistory("order-2")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, "Creation", history[0].ChangeReason)
+	require.Equal(t, "Amendment", history[1].ChangeReason)
+	require.Equal(t, "Validation", history[2].ChangeReason)
+}
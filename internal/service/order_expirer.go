@@ -0,0 +1,142 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+)
+
+const (
+	// DefaultReviewSLA is the default duration after which an order not reviewed yet fails.
+	DefaultReviewSLA = 15 * time.Minute
+	// DefaultExpiryInterval is the default interval between two checks of unreviewed orders.
+	DefaultExpiryInterval = time.Minute
+	// ReviewTimeoutReason is the change reason of events failing orders not reviewed in time.
+	ReviewTimeoutReason = "ReviewTimeout"
+)
+
+// OrderExpirer is the service interface for failing orders that are not reviewed in time.
+type OrderExpirer interface {
+	// Start checks orders periodically until ctx is done or Stop is called.
+	Start(ctx context.Context)
+	// ExpireOrders fails orders not reviewed within the review SLA, returning the failed ones.
+	ExpireOrders() []*model.Order
+	// Stop stops checking orders and waits for the current check to finish.
+	Stop()
+}
+
+type orderExpirer struct {
+	orderService OrderService
+	sla          time.Duration
+	interval     time.Duration
+	now          func() time.Time
+	logger       *slog.Logger
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// OrderExpirerOption allows customizing an OrderExpirer built with NewOrderExpirer.
+type OrderExpirerOption func(*orderExpirer)
+
+// WithReviewSLA sets how long orders may wait for their review before failing.
+func WithReviewSLA(sla time.Duration) OrderExpirerOption {
+	return func(oe *orderExpirer) {
+		oe.sla = sla
+	}
+}
+
+// WithExpiryInterval sets the interval between two checks of unreviewed orders.
+func WithExpiryInterval(interval time.Duration) OrderExpirerOption {
+	return func(oe *orderExpirer) {
+		oe.interval = interval
+	}
+}
+
+// WithExpirerLogger sets the logger reporting failed orders.
+func WithExpirerLogger(logger *slog.Logger) OrderExpirerOption {
+	return func(oe *orderExpirer) {
+		oe.logger = logger
+	}
+}
+
+// WithExpiryClock sets the clock used to expire orders. Mainly for tests.
+func WithExpiryClock(now func() time.Time) OrderExpirerOption {
+	return func(oe *orderExpirer) {
+		oe.now = now
+	}
+}
+
+func NewOrderExpirer(orderService OrderService, opts ...OrderExpirerOption) OrderExpirer {
+	oe := &orderExpirer{
+		orderService: orderService,
+		sla:          DefaultReviewSLA,
+		interval:     DefaultExpiryInterval,
+		now:          time.Now,
+		logger:       slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(oe)
+	}
+	return oe
+}
+
+func (oe *orderExpirer) Start(ctx context.Context) {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	if oe.cancel != nil {
+		return
+	}
+	ctx, oe.cancel = context.WithCancel(ctx)
+
+	oe.wg.Add(1)
+	go func() {
+		defer oe.wg.Done()
+		ticker := time.NewTicker(oe.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				oe.ExpireOrders()
+			}
+		}
+	}()
+}
+
+func (oe *orderExpirer) ExpireOrders() []*model.Order {
+	expired := oe.orderService.ExpireUnreviewedOrders(oe.now(), oe.sla)
+	for _, order := range expired {
+		oe.logger.Warn("Order has failed as it was not reviewed in time", "order_id", order.ID, "sla", oe.sla.String())
+	}
+	return expired
+}
+
+func (oe *orderExpirer) Stop() {
+	oe.mu.Lock()
+	cancel := oe.cancel
+	oe.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	oe.wg.Wait()
+}
@@ -0,0 +1,194 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/stretchr/testify/require"
+)
+
+func placeEclairOrder(t *testing.T, orderService service.OrderService) *model.Order {
+	t.Helper()
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}},
+		TotalPrice:        usd(500),
+	})
+	require.NoError(t, err)
+	return order
+}
+
+func TestOrderExpirerFailsUnreviewedOrders(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+	now := time.Now()
+	expirer := service.NewOrderExpirer(orderService,
+		service.WithReviewSLA(time.Hour), service.WithExpiryClock(func() time.Time { return now }))
+
+	unreviewed := placeEclairOrder(t, orderService)
+	reviewed := *placeEclairOrder(t, orderService)
+	reviewed.Status = model.VALIDATED
+	orderService.UpdateReviewedOrder(&model.OrderEvent{Timestamp: now.UnixMilli(), Order: reviewed, ChangeReason: "Validation"})
+	require.Equal(t, int32(1), pastryAPI.stock("Eclair Cafe"))
+
+	require.Empty(t, expirer.ExpireOrders())
+
+	now = now.Add(time.Hour + time.Second)
+	expired := expirer.ExpireOrders()
+	require.Len(t, expired, 1)
+	require.Equal(t, unreviewed.ID, expired[0].ID)
+	require.Equal(t, model.FAILED, orderService.GetOrder(unreviewed.ID).Status)
+	require.Equal(t, model.VALIDATED, orderService.GetOrder(reviewed.ID).Status)
+
+	// The timeout is published and recorded like a review, and stock is given back.
+	timeout := publisher.events[len(publisher.events)-1]
+	require.Equal(t, "ReviewTimeout", timeout.ChangeReason)
+	require.Equal(t, model.FAILED, timeout.Order.Status)
+	require.Equal(t, now.UnixMilli(), timeout.Timestamp)
+	history, err := orderService.GetOrderHistory(unreviewed.ID)
+	require.NoError(t, err)
+	require.Equal(t, "ReviewTimeout", history[len(history)-1].ChangeReason)
+	require.Equal(t, int32(3), pastryAPI.stock("Eclair Cafe"))
+
+	require.Empty(t, expirer.ExpireOrders())
+}
+
+func TestOrderExpirerIgnoresLateReviews(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	orderService := service.NewOrderService(pastryAPI, &stubPublisher{})
+	now := time.Now()
+	expirer := service.NewOrderExpirer(orderService,
+		service.WithReviewSLA(time.Hour), service.WithExpiryClock(func() time.Time { return now }))
+
+	order := placeEclairOrder(t, orderService)
+	now = now.Add(time.Hour + time.Second)
+	require.Len(t, expirer.ExpireOrders(), 1)
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+
+	// Stock of the order has been given back, a late validation must not revive it.
+	reviewed := *order
+	reviewed.Status = model.VALIDATED
+	ignored := orderService.UpdateReviewedOrder(&model.OrderEvent{Timestamp: now.UnixMilli(), Order: reviewed, ChangeReason: "Validation"})
+	require.Equal(t, model.FAILED, ignored.Status)
+	require.Equal(t, model.FAILED, orderService.GetOrder(order.ID).Status)
+	history, err := orderService.GetOrderHistory(order.ID)
+	require.NoError(t, err)
+	require.Equal(t, service.ReviewTimeoutReason, history[len(history)-1].ChangeReason)
+
+	// Replaying events leads to the same order.
+	replayed := service.NewOrderService(pastryAPI, &stubPublisher{})
+	for _, event := range append(history, model.OrderEvent{Timestamp: now.UnixMilli(), Order: reviewed, ChangeReason: "Validation"}) {
+		replayed.ReplayOrderEvent(&event)
+	}
+	require.Equal(t, orderService.GetOrder(order.ID), replayed.GetOrder(order.ID))
+}
+
+// whilePublished runs review while the event of a publisher is being delivered, failing
+// if review cannot complete in the meantime.
+func whilePublished(t *testing.T, publisher *stubPublisher, reason string, review func()) {
+	publisher.delivering = func(event *model.OrderEvent) {
+		if event.ChangeReason != reason {
+			return
+		}
+		reviewed := make(chan struct{})
+		go func() {
+			defer close(reviewed)
+			review()
+		}()
+		select {
+		case <-reviewed:
+		case <-time.After(5 * time.Second):
+			t.Error("review blocked by the publication of " + reason)
+		}
+	}
+}
+
+func TestOrderExpirerKeepsReviewsMadeWhilePublishing(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+	now := time.Now().Add(time.Hour)
+	expirer := service.NewOrderExpirer(orderService,
+		service.WithReviewSLA(time.Minute), service.WithExpiryClock(func() time.Time { return now }))
+
+	order := placeEclairOrder(t, orderService)
+	whilePublished(t, publisher, service.ReviewTimeoutReason, func() {
+		reviewed := *order
+		reviewed.Status = model.VALIDATED
+		orderService.UpdateReviewedOrder(&model.OrderEvent{Timestamp: now.UnixMilli(), Order: reviewed, ChangeReason: "Validation"})
+	})
+
+	require.Empty(t, expirer.ExpireOrders())
+	require.Equal(t, model.VALIDATED, orderService.GetOrder(order.ID).Status)
+	require.Equal(t, int32(3), pastryAPI.stock("Eclair Cafe"))
+	history, err := orderService.GetOrderHistory(order.ID)
+	require.NoError(t, err)
+	require.Equal(t, "Validation", history[len(history)-1].ChangeReason)
+
+	// Replaying events leads to the same order.
+	replayed := service.NewOrderService(pastryAPI, &stubPublisher{})
+	for _, event := range append(history, *publisher.events[len(publisher.events)-1]) {
+		replayed.ReplayOrderEvent(&event)
+	}
+	require.Equal(t, orderService.GetOrder(order.ID), replayed.GetOrder(order.ID))
+}
+
+func TestOrderExpirerRetriesWhenPublicationFails(t *testing.T) {
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(newPastryAPI(), publisher)
+	now := time.Now().Add(time.Hour)
+	expirer := service.NewOrderExpirer(orderService,
+		service.WithReviewSLA(time.Minute), service.WithExpiryClock(func() time.Time { return now }))
+
+	order := placeEclairOrder(t, orderService)
+	publisher.err = errors.New("kafka: broker transport failure")
+	require.Empty(t, expirer.ExpireOrders())
+	require.Equal(t, model.CREATED, orderService.GetOrder(order.ID).Status)
+
+	publisher.err = nil
+	require.Len(t, expirer.ExpireOrders(), 1)
+	require.Equal(t, model.FAILED, orderService.GetOrder(order.ID).Status)
+}
+
+func TestOrderExpirerChecksOrdersPeriodically(t *testing.T) {
+	orderService := service.NewOrderService(newPastryAPI(), &stubPublisher{})
+	var checks atomic.Int32
+	expirer := service.NewOrderExpirer(orderService,
+		service.WithReviewSLA(time.Minute),
+		service.WithExpiryInterval(10*time.Millisecond),
+		service.WithExpiryClock(func() time.Time {
+			checks.Add(1)
+			return time.Now().Add(time.Hour)
+		}))
+
+	order := placeEclairOrder(t, orderService)
+	expirer.Start(context.Background())
+	require.Eventually(t, func() bool {
+		return orderService.GetOrder(order.ID).Status == model.FAILED
+	}, time.Second, 10*time.Millisecond)
+
+	expirer.Stop()
+	stopped := checks.Load()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, stopped, checks.Load())
+}
@@ -0,0 +1,92 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+)
+
+// OrderRepository is the storage interface for orders and the events applied to them.
+// Implementations must be safe for concurrent use.
+type OrderRepository interface {
+	// Save stores order and appends event to its history.
+	Save(order *model.Order, event model.OrderEvent)
+	// Delete forgets an order and its history.
+	Delete(id string)
+	// Get retrieves an order by its id. May return nil if unknown.
+	Get(id string) *model.Order
+	// History retrieves a copy of the events applied to an order, oldest first. The boolean
+	// tells if the order is known.
+	History(id string) ([]model.OrderEvent, bool)
+	// Find retrieves orders matching a predicate on an order and its history. Orders and
+	// histories must not be modified.
+	Find(match func(order *model.Order, history []model.OrderEvent) bool) []*model.Order
+}
+
+type inMemoryOrderRepository struct {
+	mu      sync.RWMutex
+	orders  map[string]*model.Order
+	history map[string][]model.OrderEvent
+}
+
+// NewInMemoryOrderRepository creates a repository keeping orders in memory, lost on restart.
+func NewInMemoryOrderRepository() OrderRepository {
+	return &inMemoryOrderRepository{
+		orders:  make(map[string]*model.Order),
+		history: make(map[string][]model.OrderEvent),
+	}
+}
+
+func (r *inMemoryOrderRepository) Save(order *model.Order, event model.OrderEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.orders[order.ID] = order
+	r.history[order.ID] = append(r.history[order.ID], event)
+}
+
+func (r *inMemoryOrderRepository) Delete(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.orders, id)
+	delete(r.history, id)
+}
+
+func (r *inMemoryOrderRepository) Get(id string) *model.Order {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.orders[id]
+}
+
+func (r *inMemoryOrderRepository) History(id string) ([]model.OrderEvent, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	history, ok := r.history[id]
+	return slices.Clone(history), ok
+}
+
+func (r *inMemoryOrderRepository) Find(match func(order *model.Order, history []model.OrderEvent) bool) []*model.Order {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var found []*model.Order
+	for id, order := range r.orders {
+		if match(order, r.history[id]) {
+			found = append(found, order)
+		}
+	}
+	return found
+}
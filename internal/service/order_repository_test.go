@@ -0,0 +1,59 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service_test
+
+import (
+	"testing"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryOrderRepository(t *testing.T) {
+	repository := service.NewInMemoryOrderRepository()
+	created := &model.Order{ID: "order-1", Status: model.CREATED}
+	repository.Save(created, model.OrderEvent{Timestamp: 1, Order: *created, ChangeReason: "Creation"})
+	validated := &model.Order{ID: "order-1", Status: model.VALIDATED}
+	repository.Save(validated, model.OrderEvent{Timestamp: 2, Order: *validated, ChangeReason: "Review"})
+	other := &model.Order{ID: "order-2", Status: model.CREATED}
+	repository.Save(other, model.OrderEvent{Timestamp: 3, Order: *other, ChangeReason: "Creation"})
+
+	assert.Same(t, validated, repository.Get("order-1"))
+	assert.Nil(t, repository.Get("unknown"))
+
+	history, ok := repository.History("order-1")
+	require.True(t, ok)
+	require.Len(t, history, 2)
+	assert.Equal(t, "Creation", history[0].ChangeReason)
+	assert.Equal(t, "Review", history[1].ChangeReason)
+	history[0].ChangeReason = "Modified"
+	history, _ = repository.History("order-1")
+	assert.Equal(t, "Creation", history[0].ChangeReason)
+	_, ok = repository.History("unknown")
+	assert.False(t, ok)
+
+	found := repository.Find(func(order *model.Order, history []model.OrderEvent) bool {
+		return order.Status == model.CREATED && history[0].Timestamp > 2
+	})
+	assert.Equal(t, []*model.Order{other}, found)
+
+	repository.Delete("order-1")
+	assert.Nil(t, repository.Get("order-1"))
+	_, ok = repository.History("order-1")
+	assert.False(t, ok)
+	assert.Same(t, other, repository.Get("order-2"))
+}
@@ -15,55 +15,237 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
 )
 
-// UnavailablePastryError is raised by OrderService when a pastry is not available in inventory.
+// UnavailabilityReason tells why a pastry cannot be ordered.
+type UnavailabilityReason string
+
+const (
+	// UnknownPastry is the reason for pastries the Pastry API does not know.
+	UnknownPastry UnavailabilityReason = "unknown"
+	// OutOfStockPastry is the reason for known pastries that are not available.
+	OutOfStockPastry UnavailabilityReason = "out_of_stock"
+)
+
+// UnavailablePastry describes a pastry that cannot be ordered.
+type UnavailablePastry struct {
+	Product string
+	Reason  UnavailabilityReason
+}
+
+// UnavailablePastryError is raised by OrderService when some pastries are not available in inventory.
 type UnavailablePastryError struct {
-	product string
+	Pastries []UnavailablePastry
 }
 
 func (e *UnavailablePastryError) Error() string {
-	return e.product
+	products := make([]string, len(e.Pastries))
+	for i, pastry := range e.Pastries {
+		products[i] = pastry.Product
+	}
+	return strings.Join(products, ", ")
+}
+
+// TotalPriceMismatchError is raised by OrderService when the submitted total price of an order
+// differs from the one computed from pastry prices.
+type TotalPriceMismatchError struct {
+	Expected  model.Money
+	Submitted model.Money
+}
+
+func (e *TotalPriceMismatchError) Error() string {
+	return fmt.Sprintf("total price should be %s but %s was submitted", e.Expected, e.Submitted)
+}
+
+// OrderNotFoundError is raised by OrderService when an order does not exist.
+type OrderNotFoundError struct {
+	ID string
+}
+
+func (e *OrderNotFoundError) Error() string {
+	return "order " + e.ID + " not found"
+}
+
+// OrderNotAmendableError is raised by OrderService when an order cannot be amended anymore
+// because it has been reviewed.
+type OrderNotAmendableError struct {
+	ID     string
+	Status model.Status
+}
+
+func (e *OrderNotAmendableError) Error() string {
+	return fmt.Sprintf("order %s cannot be amended as it is %s", e.ID, e.Status)
 }
 
 // OrderService is the service interface for managing orders.
 type OrderService interface {
-	// Place a new order if valid. May return an UnavailableProductError.
-	PlaceOrder(info *model.OrderInfo) (*model.Order, error)
+	// Place a new order if valid. May return an UnavailablePastryError, a TotalPriceMismatchError
+	// or a wrapped client error if the Pastry API cannot be used to check availability.
+	PlaceOrder(ctx context.Context, info *model.OrderInfo) (*model.Order, error)
+	// Replace the products of an order that has not been reviewed yet. May return an OrderNotFoundError,
+	// an OrderNotAmendableError or the same errors as PlaceOrder.
+	AmendOrder(ctx context.Context, id string, amendment *model.OrderAmendment) (*model.Order, error)
 	// Retrieve an existing order.
 	GetOrder(id string) *model.Order
+	// Retrieve the events applied to an existing order, oldest first. May return an OrderNotFoundError.
+	GetOrderHistory(id string) ([]model.OrderEvent, error)
 	// Update an order that has been reviewed.
 	UpdateReviewedOrder(event *model.OrderEvent) *model.Order
+	// Apply a past event to rebuild orders, without publishing events nor changing stock.
+	ReplayOrderEvent(event *model.OrderEvent)
+	// Fail orders not reviewed within sla at time now, returning the failed ones.
+	ExpireUnreviewedOrders(now time.Time, sla time.Duration) []*model.Order
 }
 
 type orderService struct {
-	pastryAPI           client.PastryAPI
-	orderEventPublisher OrderEventPublisher
-	ordersRepository    map[string]*model.Order
+	pastryAPI               client.PastryAPI
+	stockAPI                client.PastryAPI
+	orderEventPublisher     OrderEventPublisher
+	availabilityConcurrency int
+	priceTolerance          int64
+	metrics                 *metrics.Metrics
+	logger                  *slog.Logger
+	ordersRepository        OrderRepository
+
+	// mu guards reservations and amendments, and keeps them consistent with stored orders:
+	// statuses are checked and orders stored with mu held. Events are published without it.
+	mu           sync.Mutex
+	reservations map[string][]stockReservation
+	// amendments holds a channel per order being amended, closed once the amendment is over.
+	amendments map[string]chan struct{}
+
+	stockMu sync.Mutex
+}
+
+const (
+	// DefaultAvailabilityConcurrency is the default number of concurrent Pastry API lookups for an order.
+	DefaultAvailabilityConcurrency = 4
+	// DefaultPriceTolerance is the default accepted difference, in minor units, between submitted
+	// and computed total prices.
+	DefaultPriceTolerance = 1
+)
+
+// OrderServiceOption allows customizing an OrderService built with NewOrderService.
+type OrderServiceOption func(*orderService)
+
+// WithAvailabilityConcurrency sets how many pastries of an order are looked up concurrently.
+func WithAvailabilityConcurrency(concurrency int) OrderServiceOption {
+	return func(os *orderService) {
+		os.availabilityConcurrency = max(concurrency, 1)
+	}
+}
+
+// WithPriceTolerance sets the accepted difference, in minor units, between submitted and computed total prices.
+func WithPriceTolerance(minorUnits int64) OrderServiceOption {
+	return func(os *orderService) {
+		os.priceTolerance = max(minorUnits, -minorUnits)
+	}
+}
+
+// WithStockPastryAPI sets the Pastry API client stock is read from before being changed. It
+// must not be cached, as stock is also changed by others. Defaults to the Pastry API client
+// of the service.
+func WithStockPastryAPI(stockAPI client.PastryAPI) OrderServiceOption {
+	return func(os *orderService) {
+		os.stockAPI = stockAPI
+	}
 }
 
-func NewOrderService(pastryAPI client.PastryAPI, orderEventPublisher OrderEventPublisher) OrderService {
-	return &orderService{
-		pastryAPI:           pastryAPI,
-		orderEventPublisher: orderEventPublisher,
-		ordersRepository:    make(map[string]*model.Order),
+// WithOrderRepository sets where orders are stored, in memory by default.
+func WithOrderRepository(repository OrderRepository) OrderServiceOption {
+	return func(os *orderService) {
+		os.ordersRepository = repository
 	}
 }
 
+// WithLogger sets the logger of the service.
+func WithLogger(logger *slog.Logger) OrderServiceOption {
+	return func(os *orderService) {
+		os.logger = logger
+	}
+}
+
+// WithMetrics sets the collectors observing placed orders.
+func WithMetrics(m *metrics.Metrics) OrderServiceOption {
+	return func(os *orderService) {
+		os.metrics = m
+	}
+}
+
+func NewOrderService(pastryAPI client.PastryAPI, orderEventPublisher OrderEventPublisher, opts ...OrderServiceOption) OrderService {
+	os := &orderService{
+		pastryAPI:               pastryAPI,
+		orderEventPublisher:     orderEventPublisher,
+		availabilityConcurrency: DefaultAvailabilityConcurrency,
+		priceTolerance:          DefaultPriceTolerance,
+		metrics:                 metrics.New(nil),
+		logger:                  slog.Default(),
+		ordersRepository:        NewInMemoryOrderRepository(),
+		reservations:            make(map[string][]stockReservation),
+		amendments:              make(map[string]chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(os)
+	}
+	if os.stockAPI == nil {
+		os.stockAPI = os.pastryAPI
+	}
+	return os
+}
+
 // PlaceOrder allows checking inventory and save and order if products are available.
-func (os *orderService) PlaceOrder(info *model.OrderInfo) (*model.Order, error) {
-	// Check availability of pastries.
-	for i := range len(info.ProductQuantities) {
-		productQuantity := info.ProductQuantities[i]
-		pastry, err := os.pastryAPI.GetPastry(productQuantity.ProductName)
-		if (err != nil) || (pastry.Status != "available") {
-			return nil, &UnavailablePastryError{product: productQuantity.ProductName}
-		}
+// Total price is computed from pastry prices and must match the submitted one.
+// Stock of ordered pastries is reserved and the order stored before publishing the creation
+// event, both being undone if publication fails.
+func (os *orderService) PlaceOrder(ctx context.Context, info *model.OrderInfo) (*model.Order, error) {
+	order, err := os.placeOrder(ctx, info)
+	var unavailableErr *UnavailablePastryError
+	switch {
+	case err == nil:
+		os.metrics.OrdersPlaced.WithLabelValues(metrics.OrderCreated).Inc()
+		os.logger.InfoContext(ctx, "Order created", "order_id", order.ID, "totalPrice", order.TotalPrice.String())
+	case errors.As(err, &unavailableErr):
+		os.metrics.OrdersPlaced.WithLabelValues(metrics.OrderUnavailable).Inc()
+		os.logger.InfoContext(ctx, "Order rejected as pastries are unavailable", "products", unavailableErr.Error())
+	default:
+		os.metrics.OrdersPlaced.WithLabelValues(metrics.OrderError).Inc()
+	}
+	return order, err
+}
+
+func (os *orderService) placeOrder(ctx context.Context, info *model.OrderInfo) (*model.Order, error) {
+	// Check availability of every pastry so that all unavailable ones are reported at once.
+	unavailable, pastries, err := os.checkAvailability(ctx, info.ProductQuantities)
+	if err != nil {
+		return nil, err
+	}
+	if len(unavailable) > 0 {
+		return nil, &UnavailablePastryError{Pastries: unavailable}
+	}
+
+	// Never trust the client with prices.
+	totalPrice, err := os.checkTotalPrice(info.ProductQuantities, pastries, info.TotalPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take ordered quantities from stock.
+	reservations, err := os.reserveStock(ctx, info.ProductQuantities, pastries)
+	if err != nil {
+		return nil, err
 	}
 
 	// Everything is available! Create a new order.
@@ -72,29 +254,308 @@ func (os *orderService) PlaceOrder(info *model.OrderInfo) (*model.Order, error)
 		ID:        uuid.New().String(),
 		Status:    model.CREATED,
 	}
+	order.TotalPrice = totalPrice
 
-	// Persist and publish creation event.
+	// Persist then publish creation event: reviews may be consumed before the publisher is
+	// done waiting for its delivery.
 	orderCreated := &model.OrderEvent{
 		Timestamp:    1000 * time.Now().Unix(),
 		Order:        *order,
 		ChangeReason: "Creation",
 	}
-	_, err := os.orderEventPublisher.PublishOrderEvent(orderCreated)
+	os.mu.Lock()
+	os.ordersRepository.Save(order, *orderCreated)
+	if len(reservations) > 0 {
+		os.reservations[order.ID] = reservations
+	}
+	os.mu.Unlock()
+
+	_, err = os.orderEventPublisher.PublishOrderEvent(ctx, orderCreated)
 	if err != nil {
+		// Stock may have been given back already by a review of the order.
+		os.mu.Lock()
+		os.ordersRepository.Delete(order.ID)
+		reservations = os.reservations[order.ID]
+		delete(os.reservations, order.ID)
+		os.mu.Unlock()
+		if len(reservations) > 0 {
+			os.releaseStock(ctx, reservations)
+		}
 		return nil, err
 	}
-	os.ordersRepository[order.ID] = order
 
 	return order, nil
 }
 
+// AmendOrder replaces products of a CREATED order once their availability and total price are
+// checked. Stock reserved for previous products is given back and stock of new ones is taken,
+// before publishing the amendment event. Amendments of an order are serialized, but reviews
+// go on meanwhile: the amendment is stored only if the order is still CREATED once published.
+func (os *orderService) AmendOrder(ctx context.Context, id string, amendment *model.OrderAmendment) (*model.Order, error) {
+	previous, previousReservations, err := os.beginAmendment(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	reservations := previousReservations
+	defer func() { os.endAmendment(ctx, id, reservations) }()
+
+	unavailable, pastries, err := os.checkAvailability(ctx, amendment.ProductQuantities)
+	if err != nil {
+		return nil, err
+	}
+	// Pastries may be out of stock because of this very order: stock is checked when reserved again.
+	unavailable = slices.DeleteFunc(unavailable, func(pastry UnavailablePastry) bool {
+		return pastry.Reason == OutOfStockPastry && pastries[pastry.Product].Stock != nil &&
+			slices.ContainsFunc(previousReservations, func(reservation stockReservation) bool {
+				return reservation.product == pastry.Product
+			})
+	})
+	if len(unavailable) > 0 {
+		return nil, &UnavailablePastryError{Pastries: unavailable}
+	}
+	totalPrice, err := os.checkTotalPrice(amendment.ProductQuantities, pastries, amendment.TotalPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	amendedReservations, err := os.replaceStock(ctx, previousReservations, trackedQuantities(amendment.ProductQuantities, pastries))
+	if err != nil {
+		return nil, err
+	}
+	reservations = amendedReservations
+
+	order := previous
+	order.ProductQuantities = amendment.ProductQuantities
+	order.TotalPrice = totalPrice
+
+	orderAmended := &model.OrderEvent{
+		Timestamp:    1000 * time.Now().Unix(),
+		Order:        order,
+		ChangeReason: "Amendment",
+	}
+	_, err = os.orderEventPublisher.PublishOrderEvent(ctx, orderAmended)
+	if err == nil {
+		err = os.saveAmendment(&order, orderAmended)
+		if err != nil {
+			os.logger.WarnContext(ctx, "Order reviewed while its amendment was published, amendment is ignored", "order_id", id, "error", err)
+		}
+	}
+	if err != nil {
+		restored, restoreErr := os.replaceStock(ctx, reservations, previousReservations)
+		if restoreErr != nil {
+			os.logger.ErrorContext(ctx, "Failed to restore stock of order", "order_id", id, "error", restoreErr)
+		} else {
+			reservations = restored
+		}
+		return nil, err
+	}
+
+	os.logger.InfoContext(ctx, "Order amended", "order_id", id, "totalPrice", totalPrice.String())
+	return &order, nil
+}
+
+// beginAmendment waits for other amendments of order id to be over, then returns the order
+// and takes its reservations until endAmendment, so that reviews do not give them back
+// meanwhile. It returns an OrderNotFoundError or an OrderNotAmendableError if the order
+// cannot be amended.
+func (os *orderService) beginAmendment(ctx context.Context, id string) (model.Order, []stockReservation, error) {
+	os.mu.Lock()
+	for os.amendments[id] != nil {
+		amending := os.amendments[id]
+		os.mu.Unlock()
+		select {
+		case <-amending:
+		case <-ctx.Done():
+			return model.Order{}, nil, ctx.Err()
+		}
+		os.mu.Lock()
+	}
+	defer os.mu.Unlock()
+
+	current := os.ordersRepository.Get(id)
+	if current == nil {
+		return model.Order{}, nil, &OrderNotFoundError{ID: id}
+	}
+	if current.Status != model.CREATED {
+		return model.Order{}, nil, &OrderNotAmendableError{ID: id, Status: current.Status}
+	}
+	os.amendments[id] = make(chan struct{})
+	reservations := os.reservations[id]
+	delete(os.reservations, id)
+	return *current, reservations, nil
+}
+
+// saveAmendment stores an amended order, unless it has been reviewed since its amendment
+// began. An OrderNotAmendableError is returned then.
+func (os *orderService) saveAmendment(order *model.Order, event *model.OrderEvent) error {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	if current := os.ordersRepository.Get(order.ID); current.Status != model.CREATED {
+		return &OrderNotAmendableError{ID: order.ID, Status: current.Status}
+	}
+	os.ordersRepository.Save(order, *event)
+	return nil
+}
+
+// endAmendment gives reservations back to order id, or to stock if the order has been
+// canceled or failed during its amendment, and lets next amendments of the order begin.
+func (os *orderService) endAmendment(ctx context.Context, id string, reservations []stockReservation) {
+	os.mu.Lock()
+	if !os.ordersRepository.Get(id).Status.Terminal() {
+		if len(reservations) > 0 {
+			os.reservations[id] = reservations
+		}
+		reservations = nil
+	}
+	close(os.amendments[id])
+	delete(os.amendments, id)
+	os.mu.Unlock()
+
+	if len(reservations) > 0 {
+		os.releaseStock(context.WithoutCancel(ctx), reservations)
+	}
+}
+
 // GetOrder allows retreiving an order by its id. May retur nil if unknown.
 func (os *orderService) GetOrder(id string) *model.Order {
-	return os.ordersRepository[id]
+	return os.ordersRepository.Get(id)
 }
 
-// UpdateReviewedOrder allows peristing an order review.
+// GetOrderHistory returns a copy of the events applied to an order, oldest first.
+func (os *orderService) GetOrderHistory(id string) ([]model.OrderEvent, error) {
+	history, ok := os.ordersRepository.History(id)
+	if !ok {
+		return nil, &OrderNotFoundError{ID: id}
+	}
+	return history, nil
+}
+
+// UpdateReviewedOrder allows peristing an order review. Stock reserved for
+// CANCELED or FAILED orders is given back.
 func (os *orderService) UpdateReviewedOrder(event *model.OrderEvent) *model.Order {
-	os.ordersRepository[event.Order.ID] = &event.Order
-	return &event.Order
+	order, _ := os.applyReview(event)
+	return order
+}
+
+// ExpireUnreviewedOrders fails CREATED orders whose creation is older than sla, publishing a
+// ReviewTimeout event for each of them. Orders whose event cannot be published stay CREATED
+// and are expired by a later call. Orders reviewed while their event is published keep
+// their review.
+func (os *orderService) ExpireUnreviewedOrders(now time.Time, sla time.Duration) []*model.Order {
+	createdBefore := now.Add(-sla).UnixMilli()
+	expired := os.ordersRepository.Find(func(order *model.Order, history []model.OrderEvent) bool {
+		return order.Status == model.CREATED && len(history) > 0 && history[0].Timestamp < createdBefore
+	})
+
+	var failed []*model.Order
+	for _, created := range expired {
+		order := *created
+		order.Status = model.FAILED
+		reviewTimeout := &model.OrderEvent{
+			Timestamp:    now.UnixMilli(),
+			Order:        order,
+			ChangeReason: ReviewTimeoutReason,
+		}
+		if _, err := os.orderEventPublisher.PublishOrderEvent(context.Background(), reviewTimeout); err != nil {
+			os.logger.Error("Failed to publish review timeout of order", "order_id", order.ID, "error", err)
+			continue
+		}
+		if expired, applied := os.applyReview(reviewTimeout); applied {
+			failed = append(failed, expired)
+		}
+	}
+	return failed
+}
+
+// applyReview stores the status of a review event, telling if it has been applied. The rest
+// of a known order is kept as the review may be about a version of the order prior to an
+// amendment. Reviews are ignored as told by reviewedOrder. Stock reserved for orders becoming
+// CANCELED or FAILED is given back.
+func (os *orderService) applyReview(event *model.OrderEvent) (*model.Order, bool) {
+	os.mu.Lock()
+	order, ok := reviewedOrder(os.ordersRepository.Get(event.Order.ID), event)
+	if !ok {
+		os.mu.Unlock()
+		os.logger.Warn("Ignored review of order", "order_id", order.ID, "status", order.Status, "reason", event.ChangeReason)
+		return &order, false
+	}
+	os.ordersRepository.Save(&order, *event)
+	var reservations []stockReservation
+	if order.Status == model.CANCELED || order.Status == model.FAILED {
+		reservations = os.reservations[order.ID]
+		delete(os.reservations, order.ID)
+	}
+	os.mu.Unlock()
+
+	if len(reservations) > 0 {
+		os.releaseStock(context.Background(), reservations)
+	}
+	return &order, true
+}
+
+// ReplayOrderEvent stores the order of a past event and records the event in its history.
+// Reviews are applied as by UpdateReviewedOrder, and amendments of reviewed orders are
+// ignored as by AmendOrder. Stock reservations are not rebuilt: stock of orders canceled
+// after a replay is not given back.
+func (os *orderService) ReplayOrderEvent(event *model.OrderEvent) {
+	order := event.Order
+	current := os.ordersRepository.Get(order.ID)
+	if order.Status == model.CREATED && current != nil && current.Status != model.CREATED {
+		return
+	}
+	if order.Status != model.CREATED {
+		var ok bool
+		if order, ok = reviewedOrder(current, event); !ok {
+			return
+		}
+	}
+	os.ordersRepository.Save(&order, *event)
+}
+
+// reviewedOrder returns current with the status of a review event, or the order of event if
+// current is unknown. It returns current and false if it cannot change anymore, or if event
+// is a review timeout of an order that has been reviewed.
+func reviewedOrder(current *model.Order, event *model.OrderEvent) (model.Order, bool) {
+	if current == nil {
+		return event.Order, true
+	}
+	order := *current
+	if order.Status.Terminal() || (event.ChangeReason == ReviewTimeoutReason && order.Status != model.CREATED) {
+		return order, false
+	}
+	order.Status = event.Order.Status
+	return order, true
+}
+
+// checkTotalPrice computes the total price of ordered pastries, returning a TotalPriceMismatchError
+// if submitted total differs.
+func (os *orderService) checkTotalPrice(productQuantities []model.ProductQuantity, pastries map[string]client.Pastry, submitted model.Money) (model.Money, error) {
+	totalPrice, err := computeTotalPrice(productQuantities, pastries)
+	if err != nil {
+		return model.Money{}, err
+	}
+	if totalPrice.Currency == "" {
+		totalPrice.Currency = submitted.Currency
+	}
+	difference, err := totalPrice.Sub(submitted)
+	if err != nil {
+		return model.Money{}, fmt.Errorf("failed to check total price: %w", err)
+	}
+	if difference.Abs().MinorUnits > os.priceTolerance {
+		return totalPrice, &TotalPriceMismatchError{Expected: totalPrice, Submitted: submitted}
+	}
+	return totalPrice, nil
+}
+
+// computeTotalPrice sums prices of ordered pastries, in the currency of their prices.
+func computeTotalPrice(productQuantities []model.ProductQuantity, pastries map[string]client.Pastry) (model.Money, error) {
+	var total model.Money
+	for _, productQuantity := range productQuantities {
+		var err error
+		total, err = total.Add(pastries[productQuantity.ProductName].Price.Multiply(productQuantity.Quantity))
+		if err != nil {
+			return model.Money{}, fmt.Errorf("failed to compute total price: %w", err)
+		}
+	}
+	return total, nil
 }
@@ -0,0 +1,847 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/metrics"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// stubPastryAPI serves pastries from memory, unknown names being not found.
+// Pastries listed in failures make the call fail, other calls wait for delay.
+type stubPastryAPI struct {
+	mu       sync.Mutex
+	pastries map[string]client.Pastry
+	failures map[string]error
+	delay    time.Duration
+	calls    atomic.Int32
+}
+
+func (s *stubPastryAPI) GetPastry(ctx context.Context, name string) (client.Pastry, error) {
+	s.calls.Add(1)
+	if err, ok := s.failures[name]; ok {
+		return client.Pastry{}, err
+	}
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return client.Pastry{}, ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pastry, ok := s.pastries[name]
+	if !ok {
+		return client.Pastry{}, &client.NotFoundError{Name: name}
+	}
+	return pastry, nil
+}
+
+func (s *stubPastryAPI) ListPastries(_ context.Context, size string) ([]client.Pastry, error) {
+	var pastries []client.Pastry
+	for _, pastry := range s.pastries {
+		if pastry.Size == size {
+			pastries = append(pastries, pastry)
+		}
+	}
+	return pastries, nil
+}
+
+func (s *stubPastryAPI) UpdatePastry(_ context.Context, name string, update client.PastryUpdate) (client.Pastry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pastry, ok := s.pastries[name]
+	if !ok {
+		return client.Pastry{}, &client.NotFoundError{Name: name}
+	}
+	if update.Price != nil {
+		pastry.Price = *update.Price
+	}
+	if update.Status != nil {
+		pastry.Status = *update.Status
+	}
+	if update.Stock != nil {
+		stock := *update.Stock
+		pastry.Stock = &stock
+	}
+	s.pastries[name] = pastry
+	return pastry, nil
+}
+
+// stubPublisher records published events in memory, or fails with err if set. While
+// delivering is called, if set, before the event is recorded.
+type stubPublisher struct {
+	mu         sync.Mutex
+	events     []*model.OrderEvent
+	err        error
+	delivering func(event *model.OrderEvent)
+}
+
+func (s *stubPublisher) PublishOrderEvent(_ context.Context, event *model.OrderEvent) (*model.OrderEvent, error) {
+	if s.delivering != nil {
+		s.delivering(event)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.events = append(s.events, event)
+	return event, nil
+}
+
+// usd is an amount of US Dollar cents.
+func usd(cents int64) model.Money {
+	return model.NewMoney(cents, model.USD)
+}
+
+func newPastryAPI() *stubPastryAPI {
+	return &stubPastryAPI{pastries: map[string]client.Pastry{
+		"Millefeuille":    {Name: "Millefeuille", Size: "L", Price: usd(440), Status: "available"},
+		"Eclair Cafe":     {Name: "Eclair Cafe", Size: "M", Price: usd(250), Status: "available"},
+		"Eclair Chocolat": {Name: "Eclair Chocolat", Size: "M", Price: usd(240), Status: "unknown"},
+		"Baba Rhum":       {Name: "Baba Rhum", Size: "L", Price: usd(320), Status: "out_of_stock"},
+	}}
+}
+
+func TestPlaceOrder(t *testing.T) {
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(newPastryAPI(), publisher)
+
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 2},
+		},
+		TotalPrice: usd(940),
+	})
+	require.NoError(t, err)
+	require.Equal(t, model.CREATED, order.Status)
+	require.Len(t, publisher.events, 1)
+	require.Equal(t, order, orderService.GetOrder(order.ID))
+}
+
+func TestPlaceOrderReportsAllUnavailablePastries(t *testing.T) {
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(newPastryAPI(), publisher)
+
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Eclair Chocolat", Quantity: 1},
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Baba Rhum", Quantity: 1},
+			{ProductName: "Paris Brest", Quantity: 1},
+		},
+		TotalPrice: usd(1240),
+	})
+
+	var unavailableErr *service.UnavailablePastryError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, []service.UnavailablePastry{
+		{Product: "Eclair Chocolat", Reason: service.UnknownPastry},
+		{Product: "Baba Rhum", Reason: service.OutOfStockPastry},
+		{Product: "Paris Brest", Reason: service.UnknownPastry},
+	}, unavailableErr.Pastries)
+	require.Empty(t, publisher.events)
+}
+
+func TestPlaceOrderLooksUpRepeatedPastriesOnce(t *testing.T) {
+	pastryAPI := newPastryAPI()
+	orderService := service.NewOrderService(pastryAPI, &stubPublisher{})
+
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 1},
+			{ProductName: "Millefeuille", Quantity: 2},
+		},
+		TotalPrice: usd(1570),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), pastryAPI.calls.Load())
+}
+
+func TestPlaceOrderFailsFastOnPastryAPIOutage(t *testing.T) {
+	pastryAPI := newPastryAPI()
+	pastryAPI.delay = 10 * time.Second
+	pastryAPI.failures = map[string]error{
+		"Eclair Cafe": &client.UnavailableError{StatusCode: http.StatusServiceUnavailable, Err: &client.StatusError{StatusCode: http.StatusServiceUnavailable}},
+	}
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher, service.WithAvailabilityConcurrency(2))
+
+	start := time.Now()
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 1},
+			{ProductName: "Baba Rhum", Quantity: 1},
+			{ProductName: "Eclair Chocolat", Quantity: 1},
+		},
+		TotalPrice: usd(1250),
+	})
+
+	var unavailableErr *client.UnavailableError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Less(t, time.Since(start), time.Second)
+	require.Empty(t, publisher.events)
+}
+
+// cancelingPastryAPI cancels the order being placed once a pastry has been looked up,
+// like a client going away.
+type cancelingPastryAPI struct {
+	*stubPastryAPI
+	cancel context.CancelFunc
+}
+
+func (c *cancelingPastryAPI) GetPastry(ctx context.Context, name string) (client.Pastry, error) {
+	defer c.cancel()
+	return c.stubPastryAPI.GetPastry(ctx, name)
+}
+
+func TestPlaceOrderFailsWhenCanceledDuringLookups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(&cancelingPastryAPI{stubPastryAPI: newPastryAPI(), cancel: cancel}, publisher,
+		service.WithAvailabilityConcurrency(1))
+
+	_, err := orderService.PlaceOrder(ctx, &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 1},
+		},
+		TotalPrice: usd(690),
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, publisher.events)
+}
+
+func TestPlaceOrderCountsOutcomes(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(newPastryAPI(), publisher, service.WithMetrics(m))
+
+	millefeuille := &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 1}},
+		TotalPrice:        usd(440),
+	}
+	_, err := orderService.PlaceOrder(context.Background(), millefeuille)
+	require.NoError(t, err)
+	_, err = orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Baba Rhum", Quantity: 1}},
+		TotalPrice:        usd(320),
+	})
+	require.Error(t, err)
+	publisher.err = errors.New("kafka: broker transport failure")
+	_, err = orderService.PlaceOrder(context.Background(), millefeuille)
+	require.Error(t, err)
+
+	require.InDelta(t, 1, testutil.ToFloat64(m.OrdersPlaced.WithLabelValues(metrics.OrderCreated)), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(m.OrdersPlaced.WithLabelValues(metrics.OrderUnavailable)), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(m.OrdersPlaced.WithLabelValues(metrics.OrderError)), 0)
+}
+
+// BenchmarkPlaceOrder places a 10 items order against a local Pastry API answering in 20ms,
+// looking up pastries one at a time and then concurrently.
+func BenchmarkPlaceOrder(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		name := strings.TrimPrefix(r.URL.Path, "/pastries/")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"` + name + `","size":"M","price":2.5,"status":"available"}`))
+	}))
+	b.Cleanup(server.Close)
+
+	info := &model.OrderInfo{CustomerID: "lbroudoux", TotalPrice: usd(2500)}
+	for i := range 10 {
+		info.ProductQuantities = append(info.ProductQuantities, model.ProductQuantity{
+			ProductName: "Pastry" + strconv.Itoa(i),
+			Quantity:    1,
+		})
+	}
+
+	for _, concurrency := range []int{1, service.DefaultAvailabilityConcurrency, 10} {
+		b.Run("concurrency-"+strconv.Itoa(concurrency), func(b *testing.B) {
+			orderService := service.NewOrderService(client.NewPastryAPIClient(server.URL), &stubPublisher{},
+				service.WithAvailabilityConcurrency(concurrency))
+			for range b.N {
+				if _, err := orderService.PlaceOrder(context.Background(), info); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// stock returns the current stock of a pastry of the stub.
+func (s *stubPastryAPI) stock(name string) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.pastries[name].Stock
+}
+
+func newStockedPastryAPI(millefeuilles, eclairs int32) *stubPastryAPI {
+	pastryAPI := newPastryAPI()
+	millefeuille := pastryAPI.pastries["Millefeuille"]
+	millefeuille.Stock = &millefeuilles
+	pastryAPI.pastries["Millefeuille"] = millefeuille
+	eclair := pastryAPI.pastries["Eclair Cafe"]
+	eclair.Stock = &eclairs
+	pastryAPI.pastries["Eclair Cafe"] = eclair
+	return pastryAPI
+}
+
+func TestPlaceOrderReservesStock(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	orderService := service.NewOrderService(pastryAPI, &stubPublisher{})
+
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 2},
+			{ProductName: "Millefeuille", Quantity: 1},
+		},
+		TotalPrice: usd(1380),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), pastryAPI.stock("Millefeuille"))
+	require.Equal(t, "out_of_stock", pastryAPI.pastries["Millefeuille"].Status)
+	require.Equal(t, int32(3), pastryAPI.stock("Eclair Cafe"))
+
+	// The last millefeuille is gone.
+	_, err = orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "jdoe",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 1}},
+		TotalPrice:        usd(440),
+	})
+	var unavailableErr *service.UnavailablePastryError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, []service.UnavailablePastry{{Product: "Millefeuille", Reason: service.OutOfStockPastry}}, unavailableErr.Pastries)
+}
+
+func TestPlaceOrderWithInsufficientStockReservesNothing(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(1, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Eclair Cafe", Quantity: 2},
+			{ProductName: "Millefeuille", Quantity: 2},
+		},
+		TotalPrice: usd(1380),
+	})
+	var unavailableErr *service.UnavailablePastryError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, []service.UnavailablePastry{{Product: "Millefeuille", Reason: service.OutOfStockPastry}}, unavailableErr.Pastries)
+	require.Equal(t, int32(1), pastryAPI.stock("Millefeuille"))
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+	require.Empty(t, publisher.events)
+}
+
+func TestPlaceOrderReleasesStockWhenPublicationFails(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{err: errors.New("broker is down")}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 2}},
+		TotalPrice:        usd(880),
+	})
+	require.Error(t, err)
+	require.Equal(t, int32(2), pastryAPI.stock("Millefeuille"))
+	require.Equal(t, "available", pastryAPI.pastries["Millefeuille"].Status)
+}
+
+func TestCanceledOrderReleasesStock(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	orderService := service.NewOrderService(pastryAPI, &stubPublisher{})
+
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}},
+		TotalPrice:        usd(500),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(3), pastryAPI.stock("Eclair Cafe"))
+
+	reviewed := *order
+	reviewed.Status = model.CANCELED
+	orderService.UpdateReviewedOrder(&model.OrderEvent{Order: reviewed, ChangeReason: "Cancellation"})
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+
+	// Releasing happens only once.
+	orderService.UpdateReviewedOrder(&model.OrderEvent{Order: reviewed, ChangeReason: "Cancellation"})
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+}
+
+func TestOrderReviewedWhilePublishingIsKept(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+
+	// Order is canceled as soon as it is sent, before its delivery is reported.
+	publisher.delivering = func(event *model.OrderEvent) {
+		reviewed := event.Order
+		reviewed.Status = model.CANCELED
+		orderService.UpdateReviewedOrder(&model.OrderEvent{Order: reviewed, ChangeReason: "Cancellation"})
+	}
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}},
+		TotalPrice:        usd(500),
+	})
+	require.NoError(t, err)
+	require.Equal(t, model.CANCELED, orderService.GetOrder(order.ID).Status)
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+
+	// Stock is given back once when publication fails after the review.
+	publisher.err = errors.New("broker is down")
+	_, err = orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}},
+		TotalPrice:        usd(500),
+	})
+	require.Error(t, err)
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+}
+
+func TestPlaceOrderForgetsOrderWhenPublicationFails(t *testing.T) {
+	publisher := &stubPublisher{err: errors.New("broker is down")}
+	orderService := service.NewOrderService(newPastryAPI(), publisher)
+
+	var orderID string
+	publisher.delivering = func(event *model.OrderEvent) {
+		orderID = event.Order.ID
+		require.NotNil(t, orderService.GetOrder(orderID))
+	}
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 1}},
+		TotalPrice:        usd(250),
+	})
+	require.Error(t, err)
+	require.NotEmpty(t, orderID)
+	require.Nil(t, orderService.GetOrder(orderID))
+	_, err = orderService.GetOrderHistory(orderID)
+	var notFoundErr *service.OrderNotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+}
+
+// versionedPastryAPI tags pastries of a stubPastryAPI with ETags and rejects updates of
+// pastries changed since they were read. Before each of its first conflicts updates, another
+// instance takes one item of the pastry.
+type versionedPastryAPI struct {
+	*stubPastryAPI
+	versions  map[string]int
+	conflicts int
+}
+
+func (v *versionedPastryAPI) GetPastryIfNoneMatch(ctx context.Context, name string, _ string) (client.Pastry, string, error) {
+	pastry, err := v.GetPastry(ctx, name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return pastry, strconv.Itoa(v.versions[name]), err
+}
+
+func (v *versionedPastryAPI) UpdatePastry(ctx context.Context, name string, update client.PastryUpdate) (client.Pastry, error) {
+	v.mu.Lock()
+	if v.conflicts > 0 {
+		v.conflicts--
+		stock := *v.pastries[name].Stock - 1
+		pastry := v.pastries[name]
+		pastry.Stock = &stock
+		v.pastries[name] = pastry
+		v.versions[name]++
+	}
+	if update.IfMatch != strconv.Itoa(v.versions[name]) {
+		v.mu.Unlock()
+		return client.Pastry{}, client.ErrPreconditionFailed
+	}
+	v.versions[name]++
+	v.mu.Unlock()
+	return v.stubPastryAPI.UpdatePastry(ctx, name, update)
+}
+
+func TestPlaceOrderReservesStockChangedConcurrently(t *testing.T) {
+	pastryAPI := &versionedPastryAPI{stubPastryAPI: newStockedPastryAPI(5, 5), versions: map[string]int{}, conflicts: 2}
+	orderService := service.NewOrderService(pastryAPI, &stubPublisher{})
+
+	_, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 2}},
+		TotalPrice:        usd(880),
+	})
+	require.NoError(t, err)
+	// Items taken by others are not overwritten.
+	require.Equal(t, int32(1), pastryAPI.stock("Millefeuille"))
+}
+
+func TestPlaceOrderReservesStockReadFromStockPastryAPI(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(3, 5)
+	cachedPastryAPI := client.NewCachedPastryAPI(pastryAPI)
+	orderService := service.NewOrderService(cachedPastryAPI, &stubPublisher{}, service.WithStockPastryAPI(pastryAPI))
+
+	// Others take millefeuilles after they have been cached.
+	_, err := cachedPastryAPI.GetPastry(context.Background(), "Millefeuille")
+	require.NoError(t, err)
+	stock := int32(1)
+	_, err = pastryAPI.UpdatePastry(context.Background(), "Millefeuille", client.PastryUpdate{Stock: &stock})
+	require.NoError(t, err)
+
+	_, err = orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 2}},
+		TotalPrice:        usd(880),
+	})
+	var unavailableErr *service.UnavailablePastryError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, int32(1), pastryAPI.stock("Millefeuille"))
+}
+
+func TestPlaceOrderComputesTotalPrice(t *testing.T) {
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(newPastryAPI(), publisher)
+
+	// A difference of a cent is tolerated, the computed total is kept.
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 2},
+		},
+		TotalPrice: usd(941),
+	})
+	require.NoError(t, err)
+	require.Equal(t, usd(940), order.TotalPrice)
+	require.Equal(t, usd(940), publisher.events[0].Order.TotalPrice)
+
+	// Others are rejected.
+	_, err = orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID: "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 2},
+		},
+		TotalPrice: usd(440),
+	})
+	var mismatchErr *service.TotalPriceMismatchError
+	require.ErrorAs(t, err, &mismatchErr)
+	require.Equal(t, usd(940), mismatchErr.Expected)
+	require.Equal(t, usd(440), mismatchErr.Submitted)
+	require.Len(t, publisher.events, 1)
+}
+
+func TestAmendOrder(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 2}},
+		TotalPrice:        usd(880),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), pastryAPI.stock("Millefeuille"))
+
+	amended, err := orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{
+			{ProductName: "Millefeuille", Quantity: 1},
+			{ProductName: "Eclair Cafe", Quantity: 3},
+		},
+		TotalPrice: usd(1190),
+	})
+	require.NoError(t, err)
+	require.Equal(t, order.ID, amended.ID)
+	require.Equal(t, "lbroudoux", amended.CustomerID)
+	require.Equal(t, model.CREATED, amended.Status)
+	require.Equal(t, usd(1190), amended.TotalPrice)
+	require.Len(t, amended.ProductQuantities, 2)
+	require.Equal(t, amended, orderService.GetOrder(order.ID))
+
+	// Amendment is published and stock follows new quantities.
+	require.Len(t, publisher.events, 2)
+	require.Equal(t, "Amendment", publisher.events[1].ChangeReason)
+	require.Equal(t, *amended, publisher.events[1].Order)
+	require.Equal(t, int32(1), pastryAPI.stock("Millefeuille"))
+	require.Equal(t, "available", pastryAPI.pastries["Millefeuille"].Status)
+	require.Equal(t, int32(2), pastryAPI.stock("Eclair Cafe"))
+
+	// And is given back on cancellation.
+	reviewed := *amended
+	reviewed.Status = model.CANCELED
+	orderService.UpdateReviewedOrder(&model.OrderEvent{Order: reviewed, ChangeReason: "Cancellation"})
+	require.Equal(t, int32(2), pastryAPI.stock("Millefeuille"))
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+}
+
+func TestReviewOfAmendedOrderKeepsAmendedProducts(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	orderService := service.NewOrderService(pastryAPI, &stubPublisher{})
+
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 2}},
+		TotalPrice:        usd(880),
+	})
+	require.NoError(t, err)
+	amended, err := orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 1}},
+		TotalPrice:        usd(250),
+	})
+	require.NoError(t, err)
+
+	// Review is about the order before its amendment, only its status is applied.
+	reviewed := *order
+	reviewed.Status = model.CANCELED
+	canceled := orderService.UpdateReviewedOrder(&model.OrderEvent{Order: reviewed, ChangeReason: "Cancellation"})
+	require.Equal(t, model.CANCELED, canceled.Status)
+	require.Equal(t, amended.ProductQuantities, canceled.ProductQuantities)
+	require.Equal(t, usd(250), canceled.TotalPrice)
+	require.Equal(t, canceled, orderService.GetOrder(order.ID))
+	require.Equal(t, int32(2), pastryAPI.stock("Millefeuille"))
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+}
+
+func TestAmendOrderRejectsUnknownAndReviewedOrders(t *testing.T) {
+	orderService := service.NewOrderService(newPastryAPI(), &stubPublisher{})
+	amendment := &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 1}},
+		TotalPrice:        usd(440),
+	}
+
+	_, err := orderService.AmendOrder(context.Background(), "unknown", amendment)
+	var notFoundErr *service.OrderNotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 1}},
+		TotalPrice:        usd(250),
+	})
+	require.NoError(t, err)
+	reviewed := *order
+	reviewed.Status = model.VALIDATED
+	orderService.UpdateReviewedOrder(&model.OrderEvent{Order: reviewed, ChangeReason: "Validation"})
+
+	_, err = orderService.AmendOrder(context.Background(), order.ID, amendment)
+	var notAmendableErr *service.OrderNotAmendableError
+	require.ErrorAs(t, err, &notAmendableErr)
+	require.Equal(t, model.VALIDATED, notAmendableErr.Status)
+}
+
+func TestAmendOrderIgnoredWhenReviewedWhilePublishing(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+
+	order := placeEclairOrder(t, orderService)
+	whilePublished(t, publisher, "Amendment", func() {
+		reviewed := *order
+		reviewed.Status = model.CANCELED
+		orderService.UpdateReviewedOrder(&model.OrderEvent{Order: reviewed, ChangeReason: "Cancellation"})
+	})
+
+	_, err := orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 1}},
+		TotalPrice:        usd(440),
+	})
+	var notAmendableErr *service.OrderNotAmendableError
+	require.ErrorAs(t, err, &notAmendableErr)
+	require.Equal(t, model.CANCELED, notAmendableErr.Status)
+
+	canceled := orderService.GetOrder(order.ID)
+	require.Equal(t, model.CANCELED, canceled.Status)
+	require.Equal(t, order.ProductQuantities, canceled.ProductQuantities)
+	// Stock of both previous and new products is back.
+	require.Equal(t, int32(2), pastryAPI.stock("Millefeuille"))
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+
+	// Replaying events leads to the same order, whatever the order of events.
+	history, err := orderService.GetOrderHistory(order.ID)
+	require.NoError(t, err)
+	replayed := service.NewOrderService(pastryAPI, &stubPublisher{})
+	for _, event := range append(history, *publisher.events[len(publisher.events)-1]) {
+		replayed.ReplayOrderEvent(&event)
+	}
+	require.Equal(t, canceled, replayed.GetOrder(order.ID))
+}
+
+func TestAmendOrderSerializesAmendments(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	orderService := service.NewOrderService(pastryAPI, &stubPublisher{})
+	order := placeEclairOrder(t, orderService)
+
+	var wg sync.WaitGroup
+	for quantity := int32(1); quantity <= 4; quantity++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+				ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: quantity}},
+				TotalPrice:        usd(250 * int64(quantity)),
+			})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// Stock follows the last amendment.
+	amended := orderService.GetOrder(order.ID)
+	require.Equal(t, 5-amended.ProductQuantities[0].Quantity, pastryAPI.stock("Eclair Cafe"))
+}
+
+func TestAmendOrderKeepsOrderWhenInvalid(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}},
+		TotalPrice:        usd(500),
+	})
+	require.NoError(t, err)
+
+	// Unavailable pastries.
+	_, err = orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Baba Rhum", Quantity: 1}},
+		TotalPrice:        usd(320),
+	})
+	var unavailableErr *service.UnavailablePastryError
+	require.ErrorAs(t, err, &unavailableErr)
+
+	// Insufficient stock.
+	_, err = orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 8}},
+		TotalPrice:        usd(2000),
+	})
+	require.ErrorAs(t, err, &unavailableErr)
+
+	// Wrong total price.
+	_, err = orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 3}},
+		TotalPrice:        usd(500),
+	})
+	var mismatchErr *service.TotalPriceMismatchError
+	require.ErrorAs(t, err, &mismatchErr)
+
+	// Publication failure.
+	publisher.err = errors.New("broker is down")
+	_, err = orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 5}},
+		TotalPrice:        usd(1250),
+	})
+	require.Error(t, err)
+
+	require.Equal(t, order, orderService.GetOrder(order.ID))
+	require.Equal(t, int32(3), pastryAPI.stock("Eclair Cafe"))
+	require.Len(t, publisher.events, 1)
+}
+
+func TestGetOrderHistory(t *testing.T) {
+	orderService := service.NewOrderService(newPastryAPI(), &stubPublisher{})
+
+	_, err := orderService.GetOrderHistory("unknown")
+	var notFoundErr *service.OrderNotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+
+	order, err := orderService.PlaceOrder(context.Background(), &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 1}},
+		TotalPrice:        usd(250),
+	})
+	require.NoError(t, err)
+	_, err = orderService.AmendOrder(context.Background(), order.ID, &model.OrderAmendment{
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 2}},
+		TotalPrice:        usd(500),
+	})
+	require.NoError(t, err)
+	validated := *orderService.GetOrder(order.ID)
+	validated.Status = model.VALIDATED
+	orderService.UpdateReviewedOrder(&model.OrderEvent{Timestamp: 1706087118451, Order: validated, ChangeReason: "Validation"})
+
+	history, err := orderService.GetOrderHistory(order.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, "Creation", history[0].ChangeReason)
+	require.Equal(t, int32(1), history[0].Order.ProductQuantities[0].Quantity)
+	require.Equal(t, "Amendment", history[1].ChangeReason)
+	require.Equal(t, usd(500), history[1].Order.TotalPrice)
+	require.Equal(t, "Validation", history[2].ChangeReason)
+	require.Equal(t, int64(1706087118451), history[2].Timestamp)
+	require.Equal(t, model.VALIDATED, history[2].Order.Status)
+}
+
+func TestReplayOrderEvent(t *testing.T) {
+	pastryAPI := newStockedPastryAPI(2, 5)
+	publisher := &stubPublisher{}
+	orderService := service.NewOrderService(pastryAPI, publisher)
+
+	created := model.Order{
+		ID:     "order-1",
+		Status: model.CREATED,
+		OrderInfo: model.OrderInfo{
+			CustomerID:        "lbroudoux",
+			ProductQuantities: []model.ProductQuantity{{ProductName: "Eclair Cafe", Quantity: 1}},
+			TotalPrice:        usd(250),
+		},
+	}
+	validated := created
+	validated.Status = model.VALIDATED
+	orderService.ReplayOrderEvent(&model.OrderEvent{Timestamp: 1706087114133, Order: created, ChangeReason: "Creation"})
+	orderService.ReplayOrderEvent(&model.OrderEvent{Timestamp: 1706087118451, Order: validated, ChangeReason: "Validation"})
+
+	require.Equal(t, model.VALIDATED, orderService.GetOrder("order-1").Status)
+	history, err := orderService.GetOrderHistory("order-1")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, "Creation", history[0].ChangeReason)
+	require.Equal(t, "Validation", history[1].ChangeReason)
+
+	// Replaying has no side effect.
+	require.Empty(t, publisher.events)
+	require.Equal(t, int32(5), pastryAPI.stock("Eclair Cafe"))
+	require.Equal(t, int32(0), pastryAPI.calls.Load())
+}
@@ -0,0 +1,133 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// checkAvailability looks up every distinct pastry of productQuantities using at most
+// availabilityConcurrency concurrent calls. Unavailable pastries are returned in order
+// of first appearance, along with the known pastries by name. The first Pastry API
+// failure cancels pending lookups and is returned, as is the error of ctx if it is done.
+func (os *orderService) checkAvailability(ctx context.Context, productQuantities []model.ProductQuantity) ([]UnavailablePastry, map[string]client.Pastry, error) {
+	// Deduplicate product names, an order may list the same pastry several times.
+	products := make([]string, 0, len(productQuantities))
+	seen := make(map[string]bool, len(productQuantities))
+	for _, productQuantity := range productQuantities {
+		if !seen[productQuantity.ProductName] {
+			seen[productQuantity.ProductName] = true
+			products = append(products, productQuantity.ProductName)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		failOnce sync.Once
+		failure  error
+		reasons  = make([]UnavailabilityReason, len(products))
+		pastries = make([]*client.Pastry, len(products))
+		slots    = make(chan struct{}, os.availabilityConcurrency)
+	)
+
+lookups:
+	for i, product := range products {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break lookups
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			pastry, reason, err := os.lookupAvailability(ctx, product)
+			if err != nil {
+				failOnce.Do(func() {
+					failure = fmt.Errorf("failed to check availability of %s: %w", product, err)
+					cancel()
+				})
+				return
+			}
+			reasons[i], pastries[i] = reason, pastry
+		}()
+	}
+	wg.Wait()
+
+	if failure != nil {
+		return nil, nil, failure
+	}
+	// Products left out when the caller gave up were not checked.
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var unavailable []UnavailablePastry
+	known := make(map[string]client.Pastry, len(products))
+	for i, product := range products {
+		if reasons[i] != "" {
+			unavailable = append(unavailable, UnavailablePastry{Product: product, Reason: reasons[i]})
+		}
+		if pastries[i] != nil {
+			known[product] = *pastries[i]
+		}
+	}
+	return unavailable, known, nil
+}
+
+// lookupAvailability gets product and tells why it cannot be ordered, or returns an empty
+// reason if it can. An unknown pastry is unavailable, any other error is an outage of the Pastry API.
+func (os *orderService) lookupAvailability(ctx context.Context, product string) (*client.Pastry, UnavailabilityReason, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "PastryAPI.GetPastry",
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("pastry.name", product)))
+	defer span.End()
+
+	pastry, err := os.pastryAPI.GetPastry(ctx, product)
+	if err != nil {
+		var notFoundErr *client.NotFoundError
+		if errors.As(err, &notFoundErr) {
+			return nil, UnknownPastry, nil
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "pastry lookup failed")
+		return nil, "", err
+	}
+
+	switch pastry.Status {
+	case "available":
+		return &pastry, "", nil
+	case "unknown":
+		return &pastry, UnknownPastry, nil
+	default:
+		return &pastry, OutOfStockPastry, nil
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/client"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+)
+
+// stockReservation is a quantity of pastry taken from the Pastry API stock for an order.
+type stockReservation struct {
+	product  string
+	quantity int32
+}
+
+// trackedQuantities sums ordered quantities of pastries whose stock is tracked by the Pastry
+// API, according to pastries previously looked up.
+func trackedQuantities(productQuantities []model.ProductQuantity, pastries map[string]client.Pastry) []stockReservation {
+	var wanted []stockReservation
+	index := make(map[string]int, len(productQuantities))
+	for _, productQuantity := range productQuantities {
+		if pastries[productQuantity.ProductName].Stock == nil {
+			continue
+		}
+		if i, ok := index[productQuantity.ProductName]; ok {
+			wanted[i].quantity += productQuantity.Quantity
+			continue
+		}
+		index[productQuantity.ProductName] = len(wanted)
+		wanted = append(wanted, stockReservation{product: productQuantity.ProductName, quantity: productQuantity.Quantity})
+	}
+	return wanted
+}
+
+// reserveStock takes ordered quantities from the stock of pastries whose stock is tracked
+// by the Pastry API, according to pastries previously looked up. It is all or nothing: if
+// some stocks are too low, an UnavailablePastryError is returned, and if the Pastry API
+// fails, the error is returned; in both cases quantities already taken are given back.
+func (os *orderService) reserveStock(ctx context.Context, productQuantities []model.ProductQuantity, pastries map[string]client.Pastry) ([]stockReservation, error) {
+	wanted := trackedQuantities(productQuantities, pastries)
+	if len(wanted) == 0 {
+		return nil, nil
+	}
+
+	// Stocks are read again then written: serialize reservations of this instance so that they do
+	// not conflict with each other, writes being conditional for changes made by others.
+	os.stockMu.Lock()
+	defer os.stockMu.Unlock()
+	return os.takeStockLocked(ctx, wanted)
+}
+
+// replaceStock gives reservations back then takes wanted quantities. It is all or nothing:
+// on failure, reservations are taken again.
+func (os *orderService) replaceStock(ctx context.Context, reservations []stockReservation, wanted []stockReservation) ([]stockReservation, error) {
+	if len(reservations) == 0 && len(wanted) == 0 {
+		return nil, nil
+	}
+
+	os.stockMu.Lock()
+	defer os.stockMu.Unlock()
+	os.releaseStockLocked(ctx, reservations)
+	reserved, err := os.takeStockLocked(ctx, wanted)
+	if err != nil {
+		if _, restoreErr := os.takeStockLocked(ctx, reservations); restoreErr != nil {
+			os.logger.ErrorContext(ctx, "Failed to take back reserved stock", "error", restoreErr)
+		}
+		return nil, err
+	}
+	return reserved, nil
+}
+
+// takeStockLocked takes wanted quantities, all or nothing. Must be called with stockMu held.
+func (os *orderService) takeStockLocked(ctx context.Context, wanted []stockReservation) ([]stockReservation, error) {
+	var reserved []stockReservation
+	var insufficient []UnavailablePastry
+	for _, reservation := range wanted {
+		tracked, err := os.adjustStock(ctx, reservation.product, -reservation.quantity)
+		switch {
+		case errors.Is(err, errInsufficientStock):
+			insufficient = append(insufficient, UnavailablePastry{Product: reservation.product, Reason: OutOfStockPastry})
+		case err != nil:
+			os.releaseStockLocked(ctx, reserved)
+			return nil, fmt.Errorf("failed to reserve stock of %s: %w", reservation.product, err)
+		case tracked:
+			reserved = append(reserved, reservation)
+		}
+	}
+
+	if len(insufficient) > 0 {
+		os.releaseStockLocked(ctx, reserved)
+		return nil, &UnavailablePastryError{Pastries: insufficient}
+	}
+	return reserved, nil
+}
+
+// releaseStock gives reserved quantities back to the Pastry API stock.
+func (os *orderService) releaseStock(ctx context.Context, reservations []stockReservation) {
+	os.stockMu.Lock()
+	defer os.stockMu.Unlock()
+	os.releaseStockLocked(ctx, reservations)
+}
+
+// releaseStockLocked gives reserved quantities back. Must be called with stockMu held.
+// Failures are logged as there is no one left to report them to.
+func (os *orderService) releaseStockLocked(ctx context.Context, reservations []stockReservation) {
+	for _, reservation := range reservations {
+		if _, err := os.adjustStock(ctx, reservation.product, reservation.quantity); err != nil {
+			os.logger.ErrorContext(ctx, "Failed to release stock", "product", reservation.product, "quantity", reservation.quantity, "error", err)
+		}
+	}
+}
+
+// maxStockUpdateAttempts bounds how many times a stock update is tried again when the
+// pastry is changed by someone else in between.
+const maxStockUpdateAttempts = 5
+
+// errInsufficientStock is returned by adjustStock when the stock is lower than the quantity to take.
+var errInsufficientStock = errors.New("insufficient stock")
+
+// adjustStock changes the stock of a pastry by delta, updating its status when stock gets
+// exhausted or replenished. It tells if the stock is tracked, untracked stocks being left
+// as is. Stock is read from the Pastry API, not from a cache, and written only if the
+// pastry has not changed since, with its ETag: on conflict, it is read and written again.
+// Pastry APIs that give no ETag are written unconditionally.
+func (os *orderService) adjustStock(ctx context.Context, product string, delta int32) (bool, error) {
+	for attempt := 0; attempt < maxStockUpdateAttempts; attempt++ {
+		pastry, etag, err := os.readStock(ctx, product)
+		if err != nil {
+			return false, err
+		}
+		if pastry.Stock == nil {
+			return false, nil
+		}
+		stock := *pastry.Stock
+		newStock := stock + delta
+		if newStock < 0 {
+			return true, errInsufficientStock
+		}
+
+		update := client.PastryUpdate{Stock: &newStock, IfMatch: etag}
+		switch {
+		case newStock == 0:
+			status := "out_of_stock"
+			update.Status = &status
+		case stock == 0:
+			status := "available"
+			update.Status = &status
+		}
+		_, err = os.pastryAPI.UpdatePastry(ctx, product, update)
+		if !errors.Is(err, client.ErrPreconditionFailed) {
+			return true, err
+		}
+		os.logger.DebugContext(ctx, "Stock changed while being updated, trying again", "product", product, "attempt", attempt+1)
+	}
+	return true, fmt.Errorf("stock of %s kept changing after %d attempts: %w", product, maxStockUpdateAttempts, client.ErrPreconditionFailed)
+}
+
+// readStock gets the current state of a pastry, with its ETag if the stock Pastry API gives one.
+func (os *orderService) readStock(ctx context.Context, product string) (client.Pastry, string, error) {
+	if conditional, ok := os.stockAPI.(client.ConditionalPastryAPI); ok {
+		return conditional.GetPastryIfNoneMatch(ctx, product, "")
+	}
+	pastry, err := os.stockAPI.GetPastry(ctx, product)
+	return pastry, "", err
+}
@@ -0,0 +1,254 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	server "github.com/microcks/microcks-testcontainers-go-demo/cmd/run"
+	app "github.com/microcks/microcks-testcontainers-go-demo/internal"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	kafkaUsername = "orders"
+	kafkaPassword = "orders-secret"
+)
+
+// writeCertificates writes in dir a CA certificate and a PEM keystore of a broker reachable on
+// localhost, signed by this CA. It returns their paths.
+func writeCertificates(t *testing.T, dir string) (caLocation, keystoreLocation string) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Order Service Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	brokerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	brokerTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	brokerDER, err := x509.CreateCertificate(rand.Reader, brokerTemplate, caTemplate, &brokerKey.PublicKey, caKey)
+	require.NoError(t, err)
+	brokerKeyDER, err := x509.MarshalPKCS8PrivateKey(brokerKey)
+	require.NoError(t, err)
+
+	caLocation = filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caLocation, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o644))
+	keystoreLocation = filepath.Join(dir, "broker.pem")
+	keystore := append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: brokerKeyDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: brokerDER})...)
+	require.NoError(t, os.WriteFile(keystoreLocation, keystore, 0o644))
+	return caLocation, keystoreLocation
+}
+
+// runSecuredKafka starts a broker only accepting SASL_SSL clients authenticated with
+// PLAIN on localhost, and returns its bootstrap servers.
+func runSecuredKafka(ctx context.Context, t *testing.T, keystoreLocation string) string {
+	// The advertised port must be known before starting, so the host port is the container one.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	kafkaContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "apache/kafka:3.8.0",
+			ExposedPorts: []string{fmt.Sprintf("%d:%d/tcp", port, port)},
+			Env: map[string]string{
+				"KAFKA_NODE_ID":                                      "1",
+				"KAFKA_PROCESS_ROLES":                                "broker,controller",
+				"KAFKA_CONTROLLER_QUORUM_VOTERS":                     "1@localhost:9094",
+				"KAFKA_LISTENERS":                                    fmt.Sprintf("SECURE://0.0.0.0:%d,BROKER://0.0.0.0:9092,CONTROLLER://0.0.0.0:9094", port),
+				"KAFKA_ADVERTISED_LISTENERS":                         fmt.Sprintf("SECURE://localhost:%d,BROKER://localhost:9092", port),
+				"KAFKA_LISTENER_SECURITY_PROTOCOL_MAP":               "SECURE:SASL_SSL,BROKER:PLAINTEXT,CONTROLLER:PLAINTEXT",
+				"KAFKA_CONTROLLER_LISTENER_NAMES":                    "CONTROLLER",
+				"KAFKA_INTER_BROKER_LISTENER_NAME":                   "BROKER",
+				"KAFKA_OFFSETS_TOPIC_REPLICATION_FACTOR":             "1",
+				"KAFKA_TRANSACTION_STATE_LOG_REPLICATION_FACTOR":     "1",
+				"KAFKA_TRANSACTION_STATE_LOG_MIN_ISR":                "1",
+				"KAFKA_GROUP_INITIAL_REBALANCE_DELAY_MS":             "0",
+				"KAFKA_SASL_ENABLED_MECHANISMS":                      "PLAIN",
+				"KAFKA_LISTENER_NAME_SECURE_SASL_ENABLED_MECHANISMS": "PLAIN",
+				"KAFKA_LISTENER_NAME_SECURE_PLAIN_SASL_JAAS_CONFIG": fmt.Sprintf(
+					`org.apache.kafka.common.security.plain.PlainLoginModule required user_%s="%s";`, kafkaUsername, kafkaPassword),
+				"KAFKA_SSL_KEYSTORE_TYPE":     "PEM",
+				"KAFKA_SSL_KEYSTORE_LOCATION": "/tmp/broker.pem",
+			},
+			Files: []testcontainers.ContainerFile{
+				{HostFilePath: keystoreLocation, ContainerFilePath: "/tmp/broker.pem", FileMode: 0o644},
+			},
+			WaitingFor: wait.ForLog("Kafka Server started").WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = kafkaContainer.Terminate(context.Background())
+	})
+	return fmt.Sprintf("localhost:%d", port)
+}
+
+func (s *BaseSuite) TestApplicationUsesKafkaOverSASLSSL() {
+	t := s.T()
+	ctx := context.Background()
+	caLocation, keystoreLocation := writeCertificates(t, t.TempDir())
+	bootstrapServers := runSecuredKafka(ctx, t, keystoreLocation)
+
+	secured := func(properties kafka.ConfigMap) *kafka.ConfigMap {
+		configMap := kafka.ConfigMap{
+			"bootstrap.servers": bootstrapServers,
+			"security.protocol": "SASL_SSL",
+			"sasl.mechanism":    "PLAIN",
+			"sasl.username":     kafkaUsername,
+			"sasl.password":     kafkaPassword,
+			"ssl.ca.location":   caLocation,
+		}
+		for key, value := range properties {
+			configMap[key] = value
+		}
+		return &configMap
+	}
+
+	// Clients without credentials are refused.
+	unsecured, err := kafka.NewAdminClient(&kafka.ConfigMap{"bootstrap.servers": bootstrapServers})
+	require.NoError(t, err)
+	_, err = unsecured.GetMetadata(nil, false, 5000)
+	unsecured.Close()
+	require.Error(t, err)
+
+	admin, err := kafka.NewAdminClient(secured(nil))
+	require.NoError(t, err)
+	defer admin.Close()
+	results, err := admin.CreateTopics(ctx, []kafka.TopicSpecification{
+		{Topic: "orders-created", NumPartitions: 1, ReplicationFactor: 1},
+		{Topic: "orders-reviewed", NumPartitions: 1, ReplicationFactor: 1},
+	})
+	require.NoError(t, err)
+	for _, result := range results {
+		require.Equal(t, kafka.ErrNoError, result.Error.Code(), result.Error.String())
+	}
+
+	application, err := server.NewApplication(&app.ApplicationProperties{
+		PastriesBaseURL:          s.pastriesBaseURL,
+		OrderEventsCreatedTopic:  "orders-created",
+		OrderEventsReviewedTopic: "orders-reviewed",
+		HTTPAddr:                 "127.0.0.1:0",
+		KafkaConfigMap: secured(kafka.ConfigMap{
+			"group.id":          "order-service",
+			"auto.offset.reset": "earliest",
+		}),
+	})
+	require.NoError(t, err)
+	go func() {
+		_ = application.Start(ctx)
+	}()
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		assert.NoError(t, application.Stop(stopCtx))
+	}()
+
+	// The producer and the consumer both reach the secured broker.
+	err = waitFor(30*time.Second, func() error {
+		resp, err := http.Get(application.BaseURL() + "/readyz")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("application is not ready: %d", resp.StatusCode)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Order events are published on the secured broker.
+	order, err := application.AppService.OrderService.PlaceOrder(ctx, &model.OrderInfo{
+		CustomerID:        "lbroudoux",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 1}},
+		TotalPrice:        model.NewMoney(440, model.USD),
+	})
+	require.NoError(t, err)
+
+	reviewer, err := kafka.NewConsumer(secured(kafka.ConfigMap{
+		"group.id":          "reviewer",
+		"auto.offset.reset": "earliest",
+	}))
+	require.NoError(t, err)
+	defer reviewer.Close()
+	require.NoError(t, reviewer.Subscribe("orders-created", nil))
+	created, err := reviewer.ReadMessage(30 * time.Second)
+	require.NoError(t, err)
+	var event model.OrderEvent
+	require.NoError(t, json.Unmarshal(created.Value, &event))
+	require.Equal(t, order.ID, event.Order.ID)
+
+	// And reviews are consumed from it.
+	event.Order.Status = model.VALIDATED
+	event.ChangeReason = "Review"
+	review, err := json.Marshal(event)
+	require.NoError(t, err)
+	producer, err := kafka.NewProducer(secured(kafka.ConfigMap{"go.delivery.reports": false}))
+	require.NoError(t, err)
+	defer producer.Close()
+	topic := "orders-reviewed"
+	require.NoError(t, producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          review,
+	}, nil))
+	require.Zero(t, producer.Flush(10000))
+
+	err = waitFor(30*time.Second, func() error {
+		if status := application.AppService.OrderService.GetOrder(order.ID).Status; status != model.VALIDATED {
+			return fmt.Errorf("order is %s", status)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
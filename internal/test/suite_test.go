@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"testing"
 	"time"
 
@@ -25,6 +27,7 @@ import (
 	server "github.com/microcks/microcks-testcontainers-go-demo/cmd/run"
 	app "github.com/microcks/microcks-testcontainers-go-demo/internal"
 	"github.com/microcks/microcks-testcontainers-go-demo/internal/model"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/service"
 	"github.com/stretchr/testify/suite"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/network"
@@ -39,6 +42,9 @@ type BaseSuite struct {
 	kafkaContainer   *kafkaTC.KafkaContainer
 	microcksEnsemble *ensemble.MicrocksContainersEnsemble
 	app              *server.App
+	brokerURL        string
+	pastriesBaseURL  string
+	reviewedTopic    string
 }
 
 func TestBaseSuite(t *testing.T) {
@@ -112,18 +118,40 @@ func (s *BaseSuite) SetupSuite() {
 		},
 	}
 
-	appRun := server.NewApplication(applicationProperties)
+	s.brokerURL = brokerURL[0]
+	s.pastriesBaseURL = baseAPIURL
+	s.reviewedTopic = reviewedTopic
+
+	appRun, err := server.NewApplication(applicationProperties)
+	s.Require().NoError(err)
 	go func() {
-		_ = appRun.Start()
+		_ = appRun.Start(ctx)
 	}()
 
 	s.app = appRun
+
+	// Wait for the application to be able to serve orders.
+	err = waitFor(30*time.Second, func() error {
+		resp, err := http.Get(appRun.BaseURL() + "/readyz")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("application is not ready: %s", body)
+		}
+		return nil
+	})
+	s.Require().NoError(err)
 }
 
 func (s *BaseSuite) TearDownSuite() {
 	ctx := context.Background()
 
-	err := s.app.Stop()
+	stopCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := s.app.Stop(stopCtx)
 	s.Require().NoError(err)
 
 	err = s.kafkaContainer.Terminate(ctx)
@@ -157,6 +185,8 @@ func (s *BaseSuite) TestOpenAPIContract() {
 		RunnerType:   client.TestRunnerTypeOPENAPISCHEMA,
 		TestEndpoint: fmt.Sprintf("http://host.testcontainers.internal:%d/api", server.DefaultApplicationPort),
 		Timeout:      2000,
+		// Other operations need orders that only exist in Microcks examples.
+		FilteredOperations: &[]string{"POST /orders"},
 	}
 	testResult, err := s.microcksEnsemble.GetMicrocksContainer().TestEndpoint(context.Background(), &testRequest)
 	s.Require().NoError(err)
@@ -181,6 +211,8 @@ func (s *BaseSuite) TestPostmanCollectionContract() {
 		RunnerType:   client.TestRunnerTypePOSTMAN,
 		TestEndpoint: fmt.Sprintf("http://host.testcontainers.internal:%d/api", server.DefaultApplicationPort),
 		Timeout:      2000,
+		// Other operations need orders that only exist in Microcks examples.
+		FilteredOperations: &[]string{"POST /orders"},
 	}
 	testResult, err := s.microcksEnsemble.GetMicrocksContainer().TestEndpoint(ctx, &testRequest)
 	s.Require().NoError(err)
@@ -205,6 +237,8 @@ func (s *BaseSuite) TestOpenAPIContractAndBusinessConformance() {
 		RunnerType:   client.TestRunnerTypeOPENAPISCHEMA,
 		TestEndpoint: fmt.Sprintf("http://host.testcontainers.internal:%d/api", server.DefaultApplicationPort),
 		Timeout:      2000,
+		// Other operations need orders that only exist in Microcks examples.
+		FilteredOperations: &[]string{"POST /orders"},
 	}
 	testResult, err := s.microcksEnsemble.GetMicrocksContainer().TestEndpoint(ctx, &testRequest)
 	s.Require().NoError(err)
@@ -252,7 +286,7 @@ func (s *BaseSuite) TestOrderEventIsPublishedWhenOrderIsCreated() {
 				Quantity:    1,
 			},
 		},
-		TotalPrice: 8.4,
+		TotalPrice: model.NewMoney(690, model.USD),
 	}
 
 	testResultChan := make(chan *client.TestResult)
@@ -264,7 +298,7 @@ func (s *BaseSuite) TestOrderEventIsPublishedWhenOrderIsCreated() {
 	time.Sleep(500 * time.Millisecond)
 
 	// Invoke the application to create an order.
-	createdOrder, err := s.app.AppService.OrderService.PlaceOrder(&info)
+	createdOrder, err := s.app.AppService.OrderService.PlaceOrder(context.Background(), &info)
 	s.Require().NoError(err)
 
 	// You may check additional stuff on createdOrder...
@@ -300,7 +334,7 @@ func (s *BaseSuite) TestOrderEventIsPublishedWhenOrderIsCreated() {
 
 	orderMap := messageMap["order"].(map[string]interface{})
 	s.Equal("123-456-789", orderMap["customerId"].(string))
-	s.InDelta(8.4, orderMap["totalPrice"].(float64), 0.01)
+	s.Equal(6.9, orderMap["totalPrice"].(float64))
 
 	productQuantities := orderMap["productQuantities"].([]interface{})
 	s.Equal(2, len(productQuantities)) //nolint:testifylint
@@ -321,3 +355,41 @@ func (s *BaseSuite) TestEventIsConsumedAndProcessedByService() {
 	})
 	s.Require().NoError(err)
 }
+
+func (s *BaseSuite) TestOrdersAreRebuiltFromOrderEvents() {
+	info := model.OrderInfo{
+		CustomerID:        "987-654-321",
+		ProductQuantities: []model.ProductQuantity{{ProductName: "Millefeuille", Quantity: 1}},
+		TotalPrice:        model.NewMoney(440, model.USD),
+	}
+	createdOrder, err := s.app.AppService.OrderService.PlaceOrder(context.Background(), &info)
+	s.Require().NoError(err)
+
+	// Rebuild orders in a fresh service, as a restarted application would.
+	err = waitFor(10*time.Second, func() error {
+		kafkaConsumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+			"bootstrap.servers":  s.brokerURL,
+			"group.id":           "order-service-replay-test",
+			"auto.offset.reset":  "earliest",
+			"enable.auto.commit": false,
+		})
+		s.Require().NoError(err)
+		defer kafkaConsumer.Close()
+
+		orderService := service.NewOrderService(nil, nil)
+		replayer := service.NewOrderEventReplayer(kafkaConsumer, []string{"orders-created", s.reviewedTopic}, orderService)
+		if _, err := replayer.Replay(context.Background()); err != nil {
+			return err
+		}
+
+		order := orderService.GetOrder(createdOrder.ID)
+		if order == nil {
+			return fmt.Errorf("order '%s' has not been rebuilt", createdOrder.ID)
+		}
+		s.Equal("987-654-321", order.CustomerID)
+		s.Equal(model.CREATED, order.Status)
+		s.Equal(info.TotalPrice, order.TotalPrice)
+		return nil
+	})
+	s.Require().NoError(err)
+}
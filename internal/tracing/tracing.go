@@ -0,0 +1,117 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing sets up OpenTelemetry tracing and propagates W3C trace context over
+// HTTP and Kafka.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ServiceName identifies the application in traces.
+	ServiceName = "order-service"
+
+	instrumentationName = "github.com/microcks/microcks-testcontainers-go-demo"
+)
+
+// propagator reads and writes W3C trace context and baggage.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Tracer returns the tracer of the application, from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// NewTracerProvider creates a provider exporting spans in batches to an OTLP/HTTP endpoint
+// such as http://localhost:4318. The provider must be shut down to flush pending spans.
+func NewTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName))),
+	), nil
+}
+
+// SetTracerProvider makes provider and W3C propagation global.
+func SetTracerProvider(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+}
+
+// ExtractHTTP returns ctx with the trace context of incoming request headers.
+func ExtractHTTP(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// InjectHTTP writes the trace context of ctx to outgoing request headers.
+func InjectHTTP(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// ExtractKafka returns ctx with the trace context of consumed message headers.
+func ExtractKafka(ctx context.Context, message *kafka.Message) context.Context {
+	return propagator.Extract(ctx, &kafkaHeaderCarrier{message: message})
+}
+
+// InjectKafka writes the trace context of ctx to headers of a message to produce.
+func InjectKafka(ctx context.Context, message *kafka.Message) {
+	propagator.Inject(ctx, &kafkaHeaderCarrier{message: message})
+}
+
+// kafkaHeaderCarrier adapts Kafka message headers to propagation.TextMapCarrier.
+type kafkaHeaderCarrier struct {
+	message *kafka.Message
+}
+
+func (c *kafkaHeaderCarrier) Get(key string) string {
+	for _, header := range c.message.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (c *kafkaHeaderCarrier) Set(key string, value string) {
+	for i, header := range c.message.Headers {
+		if header.Key == key {
+			c.message.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	c.message.Headers = append(c.message.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c *kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, len(c.message.Headers))
+	for i, header := range c.message.Headers {
+		keys[i] = header.Key
+	}
+	return keys
+}
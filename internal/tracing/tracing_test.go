@@ -0,0 +1,54 @@
+// Copyright The Microcks Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/microcks/microcks-testcontainers-go-demo/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestKafkaPropagation(t *testing.T) {
+	ctx := tracing.ExtractHTTP(context.Background(), http.Header{"Traceparent": []string{traceparent}})
+
+	message := &kafka.Message{Headers: []kafka.Header{{Key: "traceparent", Value: []byte("stale")}, {Key: "source", Value: []byte("test")}}}
+	tracing.InjectKafka(ctx, message)
+	assert.Equal(t, []kafka.Header{{Key: "traceparent", Value: []byte(traceparent)}, {Key: "source", Value: []byte("test")}}, message.Headers)
+
+	spanContext := trace.SpanContextFromContext(tracing.ExtractKafka(context.Background(), message))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spanContext.SpanID().String())
+	assert.True(t, spanContext.IsRemote())
+}
+
+func TestHTTPPropagation(t *testing.T) {
+	ctx := tracing.ExtractKafka(context.Background(), &kafka.Message{Headers: []kafka.Header{{Key: "traceparent", Value: []byte(traceparent)}}})
+
+	header := http.Header{}
+	tracing.InjectHTTP(ctx, header)
+	assert.Equal(t, traceparent, header.Get("traceparent"))
+}
+
+func TestExtractWithoutTraceContext(t *testing.T) {
+	ctx := tracing.ExtractKafka(context.Background(), &kafka.Message{})
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}